@@ -0,0 +1,446 @@
+package dumpcap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgumentError describes a field of Arguments which is set to a value
+// dumpcap would refuse or silently ignore.
+type ArgumentError struct {
+	Field  string // The field of Arguments, e.g. "SwitchOnFiles" or "DeviceArgs[1].Name"
+	Reason string // Why the field's value is wrong
+}
+
+func (e *ArgumentError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// ArgumentErrors is returned by Arguments.Validate and holds every
+// *ArgumentError found.
+type ArgumentErrors []*ArgumentError
+
+func (e ArgumentErrors) Error() string {
+	s := make([]string, len(e))
+	for i, ae := range e {
+		s[i] = ae.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// As allows errors.As to find the first *ArgumentError.
+func (e ArgumentErrors) As(target interface{}) bool {
+	if ae, ok := target.(**ArgumentError); ok && len(e) != 0 {
+		*ae = e[0]
+		return true
+	}
+	return false
+}
+
+// Validate checks the Arguments for contradicting or incomplete settings.
+// Returns nil or ArgumentErrors.
+func (a Arguments) Validate() error {
+	var errs ArgumentErrors
+	fail := func(field, reason string) {
+		errs = append(errs, &ArgumentError{Field: field, Reason: reason})
+	}
+
+	if a.FileFormat > UsePCAPNG {
+		fail("FileFormat", fmt.Sprintf("unknown file format %d", a.FileFormat))
+	}
+	if a.FileFormat == UsePCAP && len(a.DeviceArgs) > 1 {
+		fail("FileFormat", "PCAP can't be used to capture from more than one device")
+	}
+	if a.Compression > UseGzipCompression {
+		fail("Compression", fmt.Sprintf("unknown compression %d", a.Compression))
+	}
+	if a.TempDir != "" && a.FileName != "" {
+		fail("TempDir", "is only used if FileName is not given")
+	}
+	if a.FileFormat == UsePCAP && len(a.CaptureComments) != 0 {
+		fail("CaptureComments", "PCAP can't store comments")
+	}
+
+	if d := a.StopOnInterval; d < 0 || d%time.Second != 0 {
+		fail("StopOnInterval", "must be a positive number of whole seconds")
+	}
+	if d := a.SwitchOnInterval; d < 0 || d%time.Second != 0 {
+		fail("SwitchOnInterval", "must be a positive number of whole seconds")
+	}
+
+	switchCondition := a.SwitchOnDuration != 0 || a.SwitchOnFilesize != 0 ||
+		a.SwitchOnInterval != 0 || a.SwitchOnPackets != 0
+	ringbuffer := switchCondition || a.SwitchOnFiles != 0 ||
+		a.RingbufferNameTimeNum || a.RingbufferPrintName != ""
+	if ringbuffer && !switchCondition {
+		if a.RingbufferNameTimeNum {
+			fail("RingbufferNameTimeNum", "requires a condition to switch to the next file")
+		}
+		if a.RingbufferPrintName != "" {
+			fail("RingbufferPrintName", "requires a condition to switch to the next file")
+		}
+		if a.SwitchOnFiles != 0 {
+			fail("SwitchOnFiles", "requires a condition to switch to the next file")
+		}
+	}
+	if a.Compression != NoCompression && !ringbuffer {
+		fail("Compression", "only ringbuffer files are compressed")
+	}
+	if ringbuffer {
+		if a.FileName == "" {
+			fail("FileName", "is required when using a ringbuffer")
+		} else if a.FileName == StdoutFileName {
+			fail("FileName", "a ringbuffer can't be written to stdout")
+		}
+	}
+
+	for i, da := range a.DeviceArgs {
+		if da.Name == "" {
+			fail(fmt.Sprintf("DeviceArgs[%d].Name", i), "is empty")
+		}
+		if a.FileFormat == UsePCAP && da.IfName != "" {
+			fail(fmt.Sprintf("DeviceArgs[%d].IfName", i), "PCAP can't store interface names")
+		}
+		if a.FileFormat == UsePCAP && da.IfDescription != "" {
+			fail(fmt.Sprintf("DeviceArgs[%d].IfDescription", i), "PCAP can't store interface descriptions")
+		}
+		if d := da.SampleInterval; d < 0 || d%time.Millisecond != 0 {
+			fail(fmt.Sprintf("DeviceArgs[%d].SampleInterval", i), "must be a positive number of whole milliseconds")
+		} else if d != 0 && da.SampleOneOf != 0 {
+			fail(fmt.Sprintf("DeviceArgs[%d].SampleInterval", i), "can't be combined with SampleOneOf")
+		}
+		remote := da.RemoteCaptureOwnTraffic || da.RemoteUDP ||
+			da.RemoteUsername != "" || da.RemotePassword != ""
+		if remote && !isRemote(da.Name) {
+			fail(fmt.Sprintf("DeviceArgs[%d].Name", i), "remote capture options require an "+
+				rpcapPrefix+" or "+tcpRemotePrefix+" interface")
+		}
+		if da.RemotePassword != "" && da.RemoteUsername == "" {
+			fail(fmt.Sprintf("DeviceArgs[%d].RemoteUsername", i), "is required with RemotePassword")
+		}
+		if strings.Contains(da.RemoteUsername, ":") {
+			fail(fmt.Sprintf("DeviceArgs[%d].RemoteUsername", i), "can't contain ':'")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// isRemote returns true if the named interface is captured from remotely.
+func isRemote(name string) bool {
+	return strings.HasPrefix(name, rpcapPrefix) || strings.HasPrefix(name, tcpRemotePrefix)
+}
+
+// argumentOption describes how an option given to dumpcap is stored in
+// Arguments. Options which may appear after "-i" are stored in the
+// DeviceArgument of that interface if device is not nil; they are stored in
+// Arguments otherwise.
+type argumentOption struct {
+	hasValue bool
+	global   func(a *Arguments, v string) error
+	device   func(da *DeviceArgument, v string) error
+}
+
+func uintOption(field func(a *Arguments) *uint64) func(*Arguments, string) error {
+	return func(a *Arguments, v string) (err error) {
+		*field(a), err = strconv.ParseUint(v, 10, 64)
+		return err
+	}
+}
+
+func secondsOption(field func(a *Arguments) *time.Duration) func(*Arguments, string) error {
+	return func(a *Arguments, v string) error {
+		n, err := strconv.ParseUint(v, 10, 32)
+		*field(a) = time.Duration(n) * time.Second
+		return err
+	}
+}
+
+func stringOption(field func(a *Arguments) *string) func(*Arguments, string) error {
+	return func(a *Arguments, v string) error {
+		*field(a) = v
+		return nil
+	}
+}
+
+func boolOption(field func(a *Arguments) *bool) func(*Arguments, string) error {
+	return func(a *Arguments, v string) error {
+		*field(a) = true
+		return nil
+	}
+}
+
+func stringsOption(field func(a *Arguments) *[]string) func(*Arguments, string) error {
+	return func(a *Arguments, v string) error {
+		*field(a) = append(*field(a), v)
+		return nil
+	}
+}
+
+func uintDeviceOption(field func(da *DeviceArgument) *uint64) func(*DeviceArgument, string) error {
+	return func(da *DeviceArgument, v string) (err error) {
+		*field(da), err = strconv.ParseUint(v, 10, 64)
+		return err
+	}
+}
+
+func stringDeviceOption(field func(da *DeviceArgument) *string) func(*DeviceArgument, string) error {
+	return func(da *DeviceArgument, v string) error {
+		*field(da) = v
+		return nil
+	}
+}
+
+func boolDeviceOption(field func(da *DeviceArgument) *bool) func(*DeviceArgument, string) error {
+	return func(da *DeviceArgument, v string) error {
+		*field(da) = true
+		return nil
+	}
+}
+
+// The conditions understood by "-m"
+var samplingConditions = map[string]func(*DeviceArgument, string) error{
+	countArg: uintDeviceOption(func(da *DeviceArgument) *uint64 { return &da.SampleOneOf }),
+	timerArg: func(da *DeviceArgument, v string) error {
+		n, err := strconv.ParseUint(v, 10, 32)
+		da.SampleInterval = time.Duration(n) * time.Millisecond
+		return err
+	},
+}
+
+// conditionOption parses "-a" and "-b" using the given table of conditions.
+func conditionOption(conditions map[string]func(*Arguments, string) error) func(*Arguments, string) error {
+	return func(a *Arguments, v string) error {
+		cv := strings.SplitN(v, ":", 2)
+		parse, ok := conditions[cv[0]]
+		if !ok || len(cv) != 2 {
+			return fmt.Errorf("unknown condition")
+		}
+		return parse(a, cv[1])
+	}
+}
+
+// The conditions understood by "-a"
+var autostopConditions = map[string]func(*Arguments, string) error{
+	durationArg: uintOption(func(a *Arguments) *uint64 { return &a.StopOnDuration }),
+	filesArg:    uintOption(func(a *Arguments) *uint64 { return &a.StopOnFiles }),
+	filesizeArg: uintOption(func(a *Arguments) *uint64 { return &a.StopOnFilesize }),
+	intervalArg: secondsOption(func(a *Arguments) *time.Duration { return &a.StopOnInterval }),
+	packetsArg:  uintOption(func(a *Arguments) *uint64 { return &a.StopOnPackets }),
+}
+
+// The conditions understood by "-b"
+var ringbufferConditions = map[string]func(*Arguments, string) error{
+	durationArg: uintOption(func(a *Arguments) *uint64 { return &a.SwitchOnDuration }),
+	filesArg:    uintOption(func(a *Arguments) *uint64 { return &a.SwitchOnFiles }),
+	filesizeArg: uintOption(func(a *Arguments) *uint64 { return &a.SwitchOnFilesize }),
+	intervalArg: secondsOption(func(a *Arguments) *time.Duration { return &a.SwitchOnInterval }),
+	packetsArg:  uintOption(func(a *Arguments) *uint64 { return &a.SwitchOnPackets }),
+	nameTimeNumArg: func(a *Arguments, v string) error {
+		n, err := strconv.ParseUint(v, 10, 8)
+		a.RingbufferNameTimeNum = n > 1
+		return err
+	},
+	printNameArg: stringOption(func(a *Arguments) *string { return &a.RingbufferPrintName }),
+}
+
+// The options understood by ParseArguments
+var argumentOptions = map[string]argumentOption{
+	autoStopConditionArg: {true, conditionOption(autostopConditions), nil},
+	bufferedBytesArg:     {true, uintOption(func(a *Arguments) *uint64 { return &a.BufferedBytes }), nil},
+	bufferedPacketsArg:   {true, uintOption(func(a *Arguments) *uint64 { return &a.BufferedPackets }), nil},
+	captureCommentArg:    {true, stringsOption(func(a *Arguments) *[]string { return &a.CaptureComments }), nil},
+	captureFilterArg: {true,
+		stringOption(func(a *Arguments) *string { return &a.CaptureFilter }),
+		stringDeviceOption(func(da *DeviceArgument) *string { return &da.CaptureFilter })},
+	compressTypeArg: {true, func(a *Arguments, v string) error {
+		if v != gzipCompression {
+			return fmt.Errorf("unknown compression")
+		}
+		a.Compression = UseGzipCompression
+		return nil
+	}, nil},
+	disablePromiscuousArg: {false,
+		boolOption(func(a *Arguments) *bool { return &a.DisablePromiscuousMode }),
+		boolDeviceOption(func(da *DeviceArgument) *bool { return &da.DisablePromiscuousMode })},
+	enableGroupAccessArg: {false, boolOption(func(a *Arguments) *bool { return &a.EnableGroupAccess }), nil},
+	enableMonitorModeArg: {false,
+		boolOption(func(a *Arguments) *bool { return &a.EnableMonitorMode }),
+		boolDeviceOption(func(da *DeviceArgument) *bool { return &da.EnableMonitorMode })},
+	fileArg: {true, stringOption(func(a *Arguments) *string { return &a.FileName }), nil},
+	ifDescriptionArg: {true, nil,
+		stringDeviceOption(func(da *DeviceArgument) *string { return &da.IfDescription })},
+	ifNameArg: {true, nil,
+		stringDeviceOption(func(da *DeviceArgument) *string { return &da.IfName })},
+	interfaceArg: {true, nil, nil}, // handled by ParseArguments itself
+	kernelBufferSizeArg: {true,
+		uintOption(func(a *Arguments) *uint64 { return &a.KernelBufferSize }),
+		uintDeviceOption(func(da *DeviceArgument) *uint64 { return &da.KernelBufferSize })},
+	linkLayerTypeArg: {true,
+		stringOption(func(a *Arguments) *string { return &a.LinkLayerType }),
+		stringDeviceOption(func(da *DeviceArgument) *string { return &da.LinkLayerType })},
+	packetCountArg: {true, uintOption(func(a *Arguments) *uint64 { return &a.StopOnPacketCount }), nil},
+	remoteAuthArg: {true, nil, func(da *DeviceArgument, v string) error {
+		up := strings.SplitN(v, ":", 2)
+		if len(up) != 2 {
+			return fmt.Errorf("expected username:password")
+		}
+		da.RemoteUsername, da.RemotePassword = up[0], up[1]
+		return nil
+	}},
+	remoteCaptureOwnTrafficArg: {false, nil,
+		boolDeviceOption(func(da *DeviceArgument) *bool { return &da.RemoteCaptureOwnTraffic })},
+	remoteUDPArg: {false, nil,
+		boolDeviceOption(func(da *DeviceArgument) *bool { return &da.RemoteUDP })},
+	ringbufferArg: {true, conditionOption(ringbufferConditions), nil},
+	samplingArg: {true, nil, func(da *DeviceArgument, v string) error {
+		cv := strings.SplitN(v, ":", 2)
+		parse, ok := samplingConditions[cv[0]]
+		if !ok || len(cv) != 2 {
+			return fmt.Errorf("unknown sampling type")
+		}
+		return parse(da, cv[1])
+	}},
+	snaplenArg: {true,
+		uintOption(func(a *Arguments) *uint64 { return &a.SnapshotLength }),
+		uintDeviceOption(func(da *DeviceArgument) *uint64 { return &da.SnapshotLength })},
+	usePCAPArg: {false, func(a *Arguments, v string) error {
+		a.FileFormat = UsePCAP
+		return nil
+	}, nil},
+	usePCAPNGArg: {false, func(a *Arguments, v string) error {
+		a.FileFormat = UsePCAPNG
+		return nil
+	}, nil},
+	tempDirArg: {true, stringOption(func(a *Arguments) *string { return &a.TempDir }), nil},
+	timestampPrecisionArg: {true, nil, func(da *DeviceArgument, v string) error {
+		switch v {
+		case microPrecision:
+			da.NanosecondTimestamps = false
+		case nanoPrecision:
+			da.NanosecondTimestamps = true
+		default:
+			return fmt.Errorf("unknown precision")
+		}
+		return nil
+	}},
+	timestampTypeArg: {true, nil,
+		stringDeviceOption(func(da *DeviceArgument) *string { return &da.TimestampType })},
+	useThreadsArg: {false, boolOption(func(a *Arguments) *bool { return &a.UseThreads }), nil},
+	wifiChannelArg: {true,
+		stringOption(func(a *Arguments) *string { return &a.WiFiChannel }),
+		stringDeviceOption(func(da *DeviceArgument) *string { return &da.WiFiChannel })},
+}
+
+// The long forms of options understood by ParseArguments
+var longArgumentOptions = map[string]string{
+	"--autostop":            autoStopConditionArg,
+	"--buffer-size":         kernelBufferSizeArg,
+	captureCommentArg:       captureCommentArg,
+	ifDescriptionArg:        ifDescriptionArg,
+	compressTypeArg:         compressTypeArg,
+	ifNameArg:               ifNameArg,
+	tempDirArg:              tempDirArg,
+	timestampPrecisionArg:   timestampPrecisionArg,
+	timestampTypeArg:        timestampTypeArg,
+	"--interface":           interfaceArg,
+	"--linktype":            linkLayerTypeArg,
+	"--monitor-mode":        enableMonitorModeArg,
+	"--no-promiscuous-mode": disablePromiscuousArg,
+	"--ring-buffer":         ringbufferArg,
+	"--snapshot-length":     snaplenArg,
+}
+
+// ParseArguments is the inverse of Arguments.String(): It decodes a dumpcap
+// command line like "-i eth0 -f 'port 53' -b filesize:1000 -a files:10",
+// given as individual arguments, into an Arguments struct. Just like dumpcap
+// does, options which may be given per interface apply to the last interface
+// given by "-i" before them; if no interface was given yet, they are stored as
+// defaults for all interfaces.
+func ParseArguments(args []string) (Arguments, error) {
+	var a Arguments
+	device := -1
+
+	apply := func(option, value string) error {
+		opt := argumentOptions[option]
+		if option == interfaceArg {
+			a.DeviceArgs = append(a.DeviceArgs, DeviceArgument{Name: value})
+			device = len(a.DeviceArgs) - 1
+			return nil
+		}
+		var err error
+		if opt.global == nil && device < 0 {
+			return fmt.Errorf("option %s requires a preceding %s", option, interfaceArg)
+		}
+		if device >= 0 && opt.device != nil {
+			err = opt.device(&a.DeviceArgs[device], value)
+		} else {
+			err = opt.global(&a, value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value, option, err)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name, value := arg, ""
+			hasValue := false
+			if j := strings.Index(arg, "="); j >= 0 {
+				name, value, hasValue = arg[:j], arg[j+1:], true
+			}
+			option, ok := longArgumentOptions[name]
+			if !ok {
+				return Arguments{}, fmt.Errorf("unknown option %q", name)
+			}
+			if argumentOptions[option].hasValue && !hasValue {
+				if i+1 >= len(args) {
+					return Arguments{}, fmt.Errorf("option %q requires a value", name)
+				}
+				i++
+				value = args[i]
+			} else if !argumentOptions[option].hasValue && hasValue {
+				return Arguments{}, fmt.Errorf("option %q takes no value", name)
+			}
+			if err := apply(option, value); err != nil {
+				return Arguments{}, err
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// Short options may be grouped as in "-pI" and their value may
+			// follow immediately as in "-ieth0"
+			for j := 1; j < len(arg); j++ {
+				option := "-" + arg[j:j+1]
+				opt, ok := argumentOptions[option]
+				if !ok {
+					return Arguments{}, fmt.Errorf("unknown option %q", option)
+				}
+				var value string
+				if opt.hasValue {
+					if j+1 < len(arg) {
+						value = arg[j+1:]
+					} else if i+1 < len(args) {
+						i++
+						value = args[i]
+					} else {
+						return Arguments{}, fmt.Errorf("option %q requires a value", option)
+					}
+					j = len(arg)
+				}
+				if err := apply(option, value); err != nil {
+					return Arguments{}, err
+				}
+			}
+		default:
+			return Arguments{}, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,176 @@
+package dumpcap
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []Arguments{
+		{},
+		{FileName: "foobar", SwitchOnFiles: 5, SwitchOnDuration: 60},
+		{FileName: "foobar", SwitchOnInterval: time.Hour, RingbufferNameTimeNum: true},
+		{StopOnInterval: 10 * time.Second, StopOnPackets: 100},
+		{FileName: "foo", SwitchOnFilesize: 1000, Compression: UseGzipCompression},
+		{TempDir: "/var/tmp"},
+		{DeviceArgs: []DeviceArgument{{Name: "rpcap://host/eth0", RemoteUsername: "foo",
+			RemotePassword: "bar", SampleInterval: 5 * time.Millisecond}}},
+		{DeviceArgs: []DeviceArgument{{Name: "TCP@host:2002", RemoteUDP: true}}},
+		{FileFormat: UsePCAP, DeviceArgs: []DeviceArgument{{Name: "em1"}}},
+		{FileName: StdoutFileName, DeviceArgs: []DeviceArgument{{Name: "em1"}, {Name: "lo"}}},
+	}
+	for _, a := range valid {
+		if err := a.Validate(); err != nil {
+			t.Error(a, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		args   Arguments
+		fields []string
+	}{
+		{Arguments{FileFormat: 3}, []string{"FileFormat"}},
+		{Arguments{FileName: "foobar", SwitchOnFiles: 5}, []string{"SwitchOnFiles"}},
+		{Arguments{SwitchOnFilesize: 1000}, []string{"FileName"}},
+		{Arguments{SwitchOnPackets: 1000}, []string{"FileName"}},
+		{Arguments{FileName: "foo", Compression: UseGzipCompression, TempDir: "/var/tmp"},
+			[]string{"TempDir", "Compression"}},
+		{Arguments{Compression: 2}, []string{"Compression", "Compression"}},
+		{Arguments{FileName: "foobar", RingbufferPrintName: "stdout", SwitchOnFiles: 2},
+			[]string{"RingbufferPrintName", "SwitchOnFiles"}},
+		{Arguments{StopOnInterval: 1500 * time.Millisecond, SwitchOnInterval: -time.Second,
+			FileName: "foobar"}, []string{"StopOnInterval", "SwitchOnInterval"}},
+		{Arguments{FileName: StdoutFileName, SwitchOnDuration: 1}, []string{"FileName"}},
+		{Arguments{FileFormat: UsePCAP, DeviceArgs: []DeviceArgument{{Name: "em1"}, {}}},
+			[]string{"FileFormat", "DeviceArgs[1].Name"}},
+		{Arguments{FileFormat: UsePCAP, CaptureComments: []string{"foo"},
+			DeviceArgs: []DeviceArgument{{Name: "em1", IfName: "bar"}}},
+			[]string{"CaptureComments", "DeviceArgs[0].IfName"}},
+		{Arguments{FileFormat: UsePCAP, DeviceArgs: []DeviceArgument{{Name: "em1", IfDescription: "bar"}}},
+			[]string{"DeviceArgs[0].IfDescription"}},
+		{Arguments{FileFormat: UsePCAP, DeviceArgs: []DeviceArgument{{Name: "em1", IfName: "foo", IfDescription: "bar"}}},
+			[]string{"DeviceArgs[0].IfName", "DeviceArgs[0].IfDescription"}},
+		{Arguments{DeviceArgs: []DeviceArgument{{Name: "eth0", RemoteUDP: true,
+			SampleInterval: time.Millisecond, SampleOneOf: 10}}},
+			[]string{"DeviceArgs[0].SampleInterval", "DeviceArgs[0].Name"}},
+		{Arguments{DeviceArgs: []DeviceArgument{{Name: "rpcap://host/eth0",
+			RemotePassword: "bar", SampleInterval: time.Microsecond}}},
+			[]string{"DeviceArgs[0].SampleInterval", "DeviceArgs[0].RemoteUsername"}},
+		{Arguments{DeviceArgs: []DeviceArgument{{Name: "rpcap://host/eth0",
+			RemoteUsername: "foo:bar"}}}, []string{"DeviceArgs[0].RemoteUsername"}},
+	} {
+		err := tc.args.Validate()
+		errs, ok := err.(ArgumentErrors)
+		if !ok || len(errs) != len(tc.fields) {
+			t.Error(tc.args, err)
+			continue
+		}
+		for i, f := range tc.fields {
+			if errs[i].Field != f {
+				t.Error(errs[i])
+			}
+		}
+	}
+}
+
+func TestValidateErrorsAs(t *testing.T) {
+	err := Arguments{DeviceArgs: []DeviceArgument{{}}}.Validate()
+	var ae *ArgumentError
+	if !errors.As(err, &ae) || ae.Field != "DeviceArgs[0].Name" {
+		t.Error(err)
+	}
+	if err.Error() != "DeviceArgs[0].Name: is empty" {
+		t.Error(err)
+	}
+}
+
+func TestCaptureValidates(t *testing.T) {
+	d := newMockcap()
+	if c, err := d.NewCapture(Arguments{SwitchOnFiles: 5}); c != nil || err == nil {
+		t.Error(c, err)
+	}
+}
+
+func TestParseArguments(t *testing.T) {
+	args, err := ParseArguments([]string{"-f", "port 53", "-s100", "-pI",
+		"-i", "eth0", "-f", "port 80", "--snapshot-length=200", "-w", "foobar",
+		"-ilo", "--buffer-size", "4", "-b", "filesize:1000", "-a", "files:10",
+		"-c", "5", "-P", "-g", "--ifname", "loopback", "--ifdescr=local",
+		"--capture-comment", "foo", "--capture-comment", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Arguments{CaptureFilter: "port 53", SnapshotLength: 100,
+		DisablePromiscuousMode: true, EnableMonitorMode: true,
+		FileName: "foobar", SwitchOnFilesize: 1000, StopOnFiles: 10,
+		StopOnPacketCount: 5, FileFormat: UsePCAP, EnableGroupAccess: true,
+		CaptureComments: []string{"foo", "bar"},
+		DeviceArgs: []DeviceArgument{
+			{Name: "eth0", CaptureFilter: "port 80", SnapshotLength: 200},
+			{Name: "lo", KernelBufferSize: 4, IfName: "loopback", IfDescription: "local"}}}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("%#v", args)
+	}
+}
+
+func TestParseArgumentsRoundtrip(t *testing.T) {
+	args := Arguments{BufferedBytes: 123, BufferedPackets: 456,
+		CaptureFilter: "foobar", EnableMonitorMode: true, FileFormat: UsePCAPNG,
+		FileName: "foo", KernelBufferSize: 2, LinkLayerType: "EN10MB",
+		SnapshotLength: 65535, StopOnDuration: 60, StopOnFilesize: 100,
+		StopOnPacketCount: 1000, SwitchOnDuration: 10, SwitchOnFiles: 5,
+		StopOnInterval: time.Minute, StopOnPackets: 10000,
+		SwitchOnInterval: time.Hour, SwitchOnPackets: 500,
+		RingbufferNameTimeNum: true, RingbufferPrintName: "stdout",
+		Compression: UseGzipCompression, TempDir: "/var/tmp",
+		UseThreads: true, WiFiChannel: "2412",
+		DeviceArgs: []DeviceArgument{{CaptureFilter: "barfoo",
+			DisablePromiscuousMode: true, KernelBufferSize: 456,
+			LinkLayerType: "llt", Name: "dev1", WiFiChannel: "2437,HT20"},
+			{Name: "dev2", SnapshotLength: 64, EnableMonitorMode: true,
+				IfName: "veth0", IfDescription: "the other end",
+				TimestampType: "adapter", NanosecondTimestamps: true},
+			{Name: "rpcap://host/eth0", RemoteCaptureOwnTraffic: true,
+				RemoteUDP: true, RemoteUsername: "foo", RemotePassword: "b:a:r",
+				SampleInterval: 250 * time.Millisecond},
+			{Name: "rpcap://host/eth1", SampleOneOf: 100}},
+		CaptureComments: []string{"first", "second"}}
+	parsed, err := ParseArguments(args.buildArgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, args) {
+		t.Errorf("%#v", parsed)
+	}
+	if parsed.String() != args.String() {
+		t.Error(parsed)
+	}
+}
+
+func TestParseArgumentsFails(t *testing.T) {
+	for _, args := range [][]string{
+		{"-X"},
+		{"--foobar"},
+		{"-i"},
+		{"-s", "foo"},
+		{"-b", "foo:1"},
+		{"-a", "duration"},
+		{"-a", "interval:1.5"},
+		{"--compress-type=zstd"},
+		{"-b", "nametimenum:x"},
+		{"--monitor-mode=1"},
+		{"--interface"},
+		{"--ifname", "foo", "-i", "eth0"},
+		{"-i", "eth0", "--time-stamp-precision=pico"},
+		{"-i", "rpcap://host/eth0", "-A", "foo"},
+		{"-i", "rpcap://host/eth0", "-m", "timer"},
+		{"-u", "-i", "rpcap://host/eth0"},
+		{"eth0"},
+	} {
+		if _, err := ParseArguments(args); err == nil {
+			t.Error(args)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+/* Dumpcap interface for golang
+Copyright (C) 2014 Lukas Lueg, lukas.lueg@gmail.com
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation; either version 3 of the License, or (at your option) any later
+version.
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+You should have received a copy of the GNU General Public License along with
+this program; if not, write to the Free Software Foundation, Inc., 51 Franklin
+Street, Fifth Floor, Boston, MA 02110-1301  USA
+*/
+
+/*
+Package bpf models the classic BPF programs capture filters are compiled into.
+Parse assembles the textual BPF code printed by "dumpcap -d" into raw
+instructions, ParseStatement and Assemble do the same one step at a time,
+Disassemble turns them back into text and a VM executes them on
+packet data, e.g. as read by package capfile. This allows to test capture
+filters without any live interface.
+*/
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Instruction is a single raw instruction of a classic BPF program. Jump
+// offsets are relative to the following instruction.
+type Instruction struct {
+	Op uint16 // The opcode, a combination of class, size, mode and operation
+	Jt uint8  // The offset to jump by if the condition is true
+	Jf uint8  // The offset to jump by if the condition is false
+	K  uint32 // The generic operand
+}
+
+// Instruction classes
+const (
+	ClassLD   = 0x00
+	ClassLDX  = 0x01
+	ClassST   = 0x02
+	ClassSTX  = 0x03
+	ClassALU  = 0x04
+	ClassJMP  = 0x05
+	ClassRET  = 0x06
+	ClassMISC = 0x07
+)
+
+// Operand sizes of loads
+const (
+	SizeW = 0x00 // 32 bit word
+	SizeH = 0x08 // 16 bit half-word
+	SizeB = 0x10 // 8 bit byte
+)
+
+// Addressing modes of loads
+const (
+	ModeIMM = 0x00 // Immediate value
+	ModeABS = 0x20 // Absolute offset into the packet
+	ModeIND = 0x40 // Offset into the packet relative to X
+	ModeMEM = 0x60 // Scratch memory
+	ModeLEN = 0x80 // Length of the packet
+	ModeMSH = 0xa0 // IP header length
+)
+
+// Operations of ALU and JMP instructions
+const (
+	OpADD = 0x00
+	OpSUB = 0x10
+	OpMUL = 0x20
+	OpDIV = 0x30
+	OpOR  = 0x40
+	OpAND = 0x50
+	OpLSH = 0x60
+	OpRSH = 0x70
+	OpNEG = 0x80
+	OpMOD = 0x90
+	OpXOR = 0xa0
+
+	OpJA   = 0x00
+	OpJEQ  = 0x10
+	OpJGT  = 0x20
+	OpJGE  = 0x30
+	OpJSET = 0x40
+)
+
+// Sources of operands
+const (
+	SrcK = 0x00 // The operand K
+	SrcX = 0x08 // The register X
+	SrcA = 0x10 // The register A, only used by RET
+)
+
+// Operations of MISC instructions
+const (
+	MiscTAX = 0x00 // Copy A to X
+	MiscTXA = 0x80 // Copy X to A
+)
+
+// The number of words of scratch memory
+const MemWords = 16
+
+// Class returns the instruction's class, e.g. ClassLD.
+func (i Instruction) Class() uint16 {
+	return i.Op & 0x07
+}
+
+var (
+	// ErrSyntax is returned by Parse if a line can't be assembled.
+	ErrSyntax = errors.New("bpf: syntax error")
+	// ErrJump is returned by Parse if a jump target is not reachable.
+	ErrJump = errors.New("bpf: jump target out of range")
+)
+
+// Statement is a single instruction in the textual form printed by
+// "dumpcap -d". Jump targets are absolute.
+type Statement struct {
+	Opcode      string // e.g. "ldh" or "jeq"
+	Operand     string // e.g. "[12]" or "#0x800"; may be empty
+	Conditional bool   // True if the statement is a conditional jump
+	JumpTrue    int    // The statement to continue with if the condition is true
+	JumpFalse   int    // The statement to continue with if the condition is false
+}
+
+// used to decode a line of BPF code like
+// "(004) jeq      #0x800           jt 5	jf 9"
+var lineRE = regexp.MustCompile(`^\((\d+)\)\s+(\S+)\s*(.*?)` +
+	`(?:\s+jt\s+(\d+)\s+jf\s+(\d+))?\s*$`)
+
+// used to decode the operands of instructions
+var (
+	absRE = regexp.MustCompile(`^\[(\d+)\]$`)
+	indRE = regexp.MustCompile(`^\[x \+ (\d+)\]$`)
+	memRE = regexp.MustCompile(`^M\[(\d+)\]$`)
+	mshRE = regexp.MustCompile(`^4\*\(\[(\d+)\]&0xf\)$`)
+)
+
+// The mnemonics of ALU operations
+var aluOps = map[string]uint16{
+	"add": OpADD, "sub": OpSUB, "mul": OpMUL, "div": OpDIV, "mod": OpMOD,
+	"and": OpAND, "or": OpOR, "xor": OpXOR, "lsh": OpLSH, "rsh": OpRSH,
+}
+
+// The mnemonics of conditional jumps
+var jmpOps = map[string]uint16{
+	"jeq": OpJEQ, "jgt": OpJGT, "jge": OpJGE, "jset": OpJSET,
+}
+
+// The mnemonics of loads and their sizes
+var loadSizes = map[string]uint16{
+	"ld": SizeW, "ldh": SizeH, "ldb": SizeB,
+}
+
+// parseUint32 decodes numbers printed as "%d" or "0x%x"; negative numbers are
+// the result of printing large unsigned numbers as "%d".
+func parseUint32(s string) (uint32, error) {
+	if u, err := strconv.ParseUint(s, 0, 32); err == nil {
+		return uint32(u), nil
+	}
+	i, err := strconv.ParseInt(s, 10, 32)
+	return uint32(i), err
+}
+
+// immediate decodes operands like "#0x800" or "#-1".
+func immediate(operand string) (uint32, error) {
+	if !strings.HasPrefix(operand, "#") {
+		return 0, ErrSyntax
+	}
+	return parseUint32(operand[1:])
+}
+
+// submatch decodes the number captured by re in operand.
+func submatch(re *regexp.Regexp, operand string) (uint32, bool) {
+	m := re.FindStringSubmatch(operand)
+	if m == nil {
+		return 0, false
+	}
+	k, err := parseUint32(m[1])
+	return k, err == nil
+}
+
+// assemble converts a mnemonic and it's operand into an instruction. Jump
+// offsets are not filled.
+func assemble(op, operand string) (Instruction, error) {
+	if size, ok := loadSizes[op]; ok {
+		if k, ok := submatch(absRE, operand); ok {
+			return Instruction{Op: ClassLD | size | ModeABS, K: k}, nil
+		}
+		if k, ok := submatch(indRE, operand); ok {
+			return Instruction{Op: ClassLD | size | ModeIND, K: k}, nil
+		}
+		if size != SizeW {
+			return Instruction{}, ErrSyntax
+		}
+		if operand == "#pktlen" {
+			return Instruction{Op: ClassLD | SizeW | ModeLEN}, nil
+		}
+		if k, ok := submatch(memRE, operand); ok {
+			return Instruction{Op: ClassLD | ModeMEM, K: k}, nil
+		}
+		k, err := immediate(operand)
+		return Instruction{Op: ClassLD | ModeIMM, K: k}, err
+	}
+	if op, ok := aluOps[op]; ok {
+		if operand == "x" {
+			return Instruction{Op: ClassALU | op | SrcX}, nil
+		}
+		k, err := immediate(operand)
+		return Instruction{Op: ClassALU | op | SrcK, K: k}, err
+	}
+	if op, ok := jmpOps[op]; ok {
+		if operand == "x" {
+			return Instruction{Op: ClassJMP | op | SrcX}, nil
+		}
+		k, err := immediate(operand)
+		return Instruction{Op: ClassJMP | op | SrcK, K: k}, err
+	}
+
+	switch op {
+	case "ldx":
+		if operand == "#pktlen" {
+			return Instruction{Op: ClassLDX | SizeW | ModeLEN}, nil
+		}
+		if k, ok := submatch(memRE, operand); ok {
+			return Instruction{Op: ClassLDX | ModeMEM, K: k}, nil
+		}
+		k, err := immediate(operand)
+		return Instruction{Op: ClassLDX | ModeIMM, K: k}, err
+	case "ldxb":
+		if k, ok := submatch(mshRE, operand); ok {
+			return Instruction{Op: ClassLDX | SizeB | ModeMSH, K: k}, nil
+		}
+	case "st", "stx":
+		class := uint16(ClassST)
+		if op == "stx" {
+			class = ClassSTX
+		}
+		if k, ok := submatch(memRE, operand); ok {
+			return Instruction{Op: class, K: k}, nil
+		}
+	case "ret":
+		if operand == "" || operand == "a" {
+			return Instruction{Op: ClassRET | SrcA}, nil
+		}
+		if operand == "x" {
+			return Instruction{Op: ClassRET | SrcX}, nil
+		}
+		k, err := immediate(operand)
+		return Instruction{Op: ClassRET | SrcK, K: k}, err
+	case "neg":
+		if operand == "" {
+			return Instruction{Op: ClassALU | OpNEG}, nil
+		}
+	case "tax", "txa":
+		misc := uint16(MiscTAX)
+		if op == "txa" {
+			misc = MiscTXA
+		}
+		if operand == "" {
+			return Instruction{Op: ClassMISC | misc}, nil
+		}
+	}
+	return Instruction{}, ErrSyntax
+}
+
+// ParseStatement decodes a single line of BPF code like
+// "(004) jeq      #0x800           jt 5	jf 9" into the statement's number and
+// the statement itself, without assembling it. Returns ErrSyntax if the line
+// is not a statement.
+func ParseStatement(line string) (int, Statement, error) {
+	m := lineRE.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return 0, Statement{}, ErrSyntax
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, Statement{}, ErrSyntax
+	}
+	s := Statement{Opcode: m[2], Operand: m[3]}
+	if m[4] != "" {
+		s.Conditional = true
+		if s.JumpTrue, err = strconv.Atoi(m[4]); err != nil {
+			return 0, Statement{}, ErrSyntax
+		}
+		if s.JumpFalse, err = strconv.Atoi(m[5]); err != nil {
+			return 0, Statement{}, ErrSyntax
+		}
+	}
+	return n, s, nil
+}
+
+// assembleStatement converts the statement at index n into an instruction.
+func assembleStatement(n int, s Statement) (Instruction, error) {
+	var ins Instruction
+	if s.Opcode == "ja" {
+		target, err := strconv.Atoi(s.Operand)
+		if err != nil {
+			return Instruction{}, ErrSyntax
+		}
+		if target <= n {
+			return Instruction{}, ErrJump
+		}
+		ins = Instruction{Op: ClassJMP | OpJA, K: uint32(target - n - 1)}
+	} else {
+		var err error
+		if ins, err = assemble(s.Opcode, s.Operand); err != nil {
+			return Instruction{}, err
+		}
+	}
+
+	conditional := ins.Class() == ClassJMP && ins.Op&0xf0 != OpJA
+	if conditional != s.Conditional {
+		return Instruction{}, ErrSyntax
+	}
+	if conditional {
+		targets := []int{s.JumpTrue, s.JumpFalse}
+		for i, p := range []*uint8{&ins.Jt, &ins.Jf} {
+			if targets[i] <= n || targets[i]-n-1 > 0xff {
+				return Instruction{}, ErrJump
+			}
+			*p = uint8(targets[i] - n - 1)
+		}
+	}
+	return ins, nil
+}
+
+// Assemble converts statements into raw instructions; the jump targets of
+// each statement refer to the statements' indices.
+func Assemble(stmts []Statement) ([]Instruction, error) {
+	prog := make([]Instruction, len(stmts))
+	for n, s := range stmts {
+		ins, err := assembleStatement(n, s)
+		if err != nil {
+			return nil, fmt.Errorf("%w in statement %d", err, n)
+		}
+		prog[n] = ins
+	}
+	return prog, nil
+}
+
+// Parse assembles BPF code as printed by "dumpcap -d" or Disassemble. Lines
+// which do not start with an instruction's number, like the name of the
+// interface, are ignored.
+func Parse(text string) ([]Instruction, error) {
+	var prog []Instruction
+	for lineno, line := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "(") {
+			continue
+		}
+		n, s, err := ParseStatement(line)
+		if err == nil && n != len(prog) {
+			err = ErrSyntax
+		}
+		var ins Instruction
+		if err == nil {
+			ins, err = assembleStatement(n, s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w in line %d: %q", err, lineno+1, line)
+		}
+		prog = append(prog, ins)
+	}
+	return prog, nil
+}
+
+// disassemble returns the mnemonic and operand of the instruction at index n.
+func (i Instruction) disassemble(n int) (op, operand string) {
+	size := map[uint16]string{SizeW: "ld", SizeH: "ldh", SizeB: "ldb"}[i.Op&0x18]
+	switch i.Class() {
+	case ClassLD:
+		switch i.Op & 0xe0 {
+		case ModeABS:
+			return size, fmt.Sprintf("[%d]", i.K)
+		case ModeIND:
+			return size, fmt.Sprintf("[x + %d]", i.K)
+		case ModeLEN:
+			return "ld", "#pktlen"
+		case ModeMEM:
+			return "ld", fmt.Sprintf("M[%d]", i.K)
+		case ModeIMM:
+			return "ld", fmt.Sprintf("#0x%x", i.K)
+		}
+	case ClassLDX:
+		switch i.Op & 0xe0 {
+		case ModeLEN:
+			return "ldx", "#pktlen"
+		case ModeMEM:
+			return "ldx", fmt.Sprintf("M[%d]", i.K)
+		case ModeMSH:
+			return "ldxb", fmt.Sprintf("4*([%d]&0xf)", i.K)
+		case ModeIMM:
+			return "ldx", fmt.Sprintf("#0x%x", i.K)
+		}
+	case ClassST:
+		return "st", fmt.Sprintf("M[%d]", i.K)
+	case ClassSTX:
+		return "stx", fmt.Sprintf("M[%d]", i.K)
+	case ClassALU:
+		if i.Op&0xf0 == OpNEG {
+			return "neg", ""
+		}
+		for name, op := range aluOps {
+			if i.Op&0xf0 == op {
+				if i.Op&SrcX != 0 {
+					return name, "x"
+				}
+				switch op {
+				case OpAND, OpOR, OpXOR:
+					return name, fmt.Sprintf("#0x%x", i.K)
+				}
+				return name, fmt.Sprintf("#%d", i.K)
+			}
+		}
+	case ClassJMP:
+		if i.Op&0xf0 == OpJA {
+			return "ja", strconv.Itoa(n + 1 + int(i.K))
+		}
+		for name, op := range jmpOps {
+			if i.Op&0xf0 == op {
+				if i.Op&SrcX != 0 {
+					return name, "x"
+				}
+				return name, fmt.Sprintf("#0x%x", i.K)
+			}
+		}
+	case ClassRET:
+		switch i.Op & 0x18 {
+		case SrcA:
+			return "ret", ""
+		case SrcX:
+			return "ret", "x"
+		}
+		return "ret", fmt.Sprintf("#%d", i.K)
+	case ClassMISC:
+		if i.Op&0xf8 == MiscTXA {
+			return "txa", ""
+		}
+		return "tax", ""
+	}
+	return "unimp", fmt.Sprintf("0x%x", i.Op)
+}
+
+// Disassemble returns the program in the textual format printed by
+// "dumpcap -d", one instruction per line.
+func Disassemble(prog []Instruction) string {
+	var b strings.Builder
+	for n, ins := range prog {
+		op, operand := ins.disassemble(n)
+		if ins.Class() == ClassJMP && ins.Op&0xf0 != OpJA {
+			fmt.Fprintf(&b, "(%03d) %-8s %-16s jt %d\tjf %d\n", n, op, operand,
+				n+1+int(ins.Jt), n+1+int(ins.Jf))
+		} else {
+			fmt.Fprintf(&b, "(%03d) %-8s %s\n", n, op, operand)
+		}
+	}
+	return b.String()
+}
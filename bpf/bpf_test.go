@@ -0,0 +1,380 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lukaslueg/dumpcap/capfile"
+)
+
+// The output of "dumpcap -d -f 'ip and udp port 53'" on an ethernet device
+const dnsFilter = "(000) ldh      [12]\n" +
+	"(001) jeq      #0x800           jt 2\tjf 12\n" +
+	"(002) ldb      [23]\n" +
+	"(003) jeq      #0x11            jt 4\tjf 12\n" +
+	"(004) ldh      [20]\n" +
+	"(005) jset     #0x1fff          jt 12\tjf 6\n" +
+	"(006) ldxb     4*([14]&0xf)\n" +
+	"(007) ldh      [x + 14]\n" +
+	"(008) jeq      #0x35            jt 11\tjf 9\n" +
+	"(009) ldh      [x + 16]\n" +
+	"(010) jeq      #0x35            jt 11\tjf 12\n" +
+	"(011) ret      #262144\n" +
+	"(012) ret      #0\n"
+
+// A program using every kind of instruction
+const allInstructions = "(000) ld       [0]\n" +
+	"(001) ldh      [4]\n" +
+	"(002) ldb      [6]\n" +
+	"(003) ld       [x + 1]\n" +
+	"(004) ldh      [x + 2]\n" +
+	"(005) ldb      [x + 3]\n" +
+	"(006) ld       #pktlen\n" +
+	"(007) ld       #0x2a\n" +
+	"(008) ld       M[1]\n" +
+	"(009) ldx      #0x2\n" +
+	"(010) ldx      M[2]\n" +
+	"(011) ldx      #pktlen\n" +
+	"(012) ldxb     4*([14]&0xf)\n" +
+	"(013) st       M[3]\n" +
+	"(014) stx      M[15]\n" +
+	"(015) add      #1\n" +
+	"(016) sub      x\n" +
+	"(017) mul      #3\n" +
+	"(018) div      #2\n" +
+	"(019) mod      #7\n" +
+	"(020) and      #0xff\n" +
+	"(021) or       x\n" +
+	"(022) xor      #0x1\n" +
+	"(023) lsh      #2\n" +
+	"(024) rsh      x\n" +
+	"(025) neg      \n" +
+	"(026) tax      \n" +
+	"(027) txa      \n" +
+	"(028) ja       30\n" +
+	"(029) jgt      x                jt 30\tjf 31\n" +
+	"(030) jge      #0x10            jt 31\tjf 32\n" +
+	"(031) ret      \n" +
+	"(032) ret      x\n"
+
+// udpPacket returns an ethernet frame carrying an IPv4 packet with the given
+// protocol, fragment offset and destination port.
+func udpPacket(etherType uint16, proto byte, fragment uint16, port uint16) []byte {
+	p := make([]byte, 14+20+8)
+	p[12], p[13] = byte(etherType>>8), byte(etherType)
+	p[14] = 0x45
+	p[20], p[21] = byte(fragment>>8), byte(fragment)
+	p[23] = proto
+	p[34], p[35] = 0x12, 0x34
+	p[36], p[37] = byte(port>>8), byte(port)
+	return p
+}
+
+func TestParse(t *testing.T) {
+	prog, err := Parse("em1\n" + dnsFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog) != 13 {
+		t.Fatal(prog)
+	}
+	for i, expected := range map[int]Instruction{
+		0:  {Op: ClassLD | SizeH | ModeABS, K: 12},
+		1:  {Op: ClassJMP | OpJEQ | SrcK, Jt: 0, Jf: 10, K: 0x800},
+		5:  {Op: ClassJMP | OpJSET | SrcK, Jt: 6, Jf: 0, K: 0x1fff},
+		6:  {Op: ClassLDX | SizeB | ModeMSH, K: 14},
+		7:  {Op: ClassLD | SizeH | ModeIND, K: 14},
+		11: {Op: ClassRET | SrcK, K: 262144},
+	} {
+		if prog[i] != expected {
+			t.Error(i, prog[i])
+		}
+	}
+	if Disassemble(prog) != dnsFilter {
+		t.Error(Disassemble(prog))
+	}
+
+	prog, err = Parse(allInstructions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Disassemble(prog) != allInstructions {
+		t.Error(Disassemble(prog))
+	}
+
+	prog, err = Parse("(000) add      #-1\n")
+	if err != nil || prog[0].K != 0xffffffff {
+		t.Error(prog, err)
+	}
+}
+
+func TestParseStatement(t *testing.T) {
+	n, s, err := ParseStatement("(001) jeq      #0x800           jt 2\tjf 12")
+	if err != nil || n != 1 || s != (Statement{Opcode: "jeq", Operand: "#0x800",
+		Conditional: true, JumpTrue: 2, JumpFalse: 12}) {
+		t.Error(n, s, err)
+	}
+	if _, _, err = ParseStatement("em1"); err != ErrSyntax {
+		t.Error(err)
+	}
+
+	var stmts []Statement
+	for _, line := range strings.Split(strings.TrimSpace(dnsFilter), "\n") {
+		_, s, err := ParseStatement(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts = append(stmts, s)
+	}
+	prog, err := Assemble(stmts)
+	if err != nil || Disassemble(prog) != dnsFilter {
+		t.Error(prog, err)
+	}
+	if _, err = Assemble([]Statement{{Opcode: "ja", Operand: "0"}}); !errors.Is(err, ErrJump) {
+		t.Error(err)
+	}
+}
+
+func TestParseFails(t *testing.T) {
+	for text, expected := range map[string]error{
+		"(000) foo      #1\n":                               ErrSyntax,
+		"(001) ret      #0\n":                               ErrSyntax,
+		"(000) ldh      #0x1\n":                             ErrSyntax,
+		"(000) ret      #0            jt 1\tjf 1\n":         ErrSyntax,
+		"(000) jeq      #0x1\n":                             ErrSyntax,
+		"(000) jeq      #0x1             jt 0\tjf 1\n":      ErrJump,
+		"(000) jeq      #0x1             jt 1\tjf 300\n":    ErrJump,
+		"(000) ja       0\n":                                ErrJump,
+		"(000) ldxb     [14]\n":                             ErrSyntax,
+		"(000) st       #1\n":                               ErrSyntax,
+		"(000) tax      x\n":                                ErrSyntax,
+		"(000) ld       #0x1\n(001) ldh      [99999999999]": ErrSyntax,
+	} {
+		if _, err := Parse(text); !errors.Is(err, expected) {
+			t.Errorf("%q: %v", text, err)
+		}
+	}
+}
+
+func TestNewVM(t *testing.T) {
+	for _, prog := range [][]Instruction{
+		nil,
+		{{Op: ClassLD | ModeIMM}},
+		{{Op: 0xffff}, {Op: ClassRET}},
+		{{Op: ClassLD | ModeMEM, K: MemWords}, {Op: ClassRET}},
+		{{Op: ClassST, K: MemWords}, {Op: ClassRET}},
+		{{Op: ClassALU | OpDIV | SrcK}, {Op: ClassRET}},
+		{{Op: ClassALU | OpMOD | SrcK}, {Op: ClassRET}},
+		{{Op: ClassJMP | OpJA, K: 1}, {Op: ClassRET}},
+		{{Op: ClassJMP | OpJEQ, Jf: 1}, {Op: ClassRET}},
+	} {
+		if _, err := NewVM(prog); !errors.Is(err, ErrInvalidProgram) {
+			t.Error(prog, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	prog, err := Parse(dnsFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := NewVM(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		packet   []byte
+		expected uint32
+	}{
+		{udpPacket(0x800, 17, 0, 53), 262144},
+		{udpPacket(0x800, 17, 0, 80), 0},
+		{udpPacket(0x800, 6, 0, 53), 0},
+		{udpPacket(0x86dd, 17, 0, 53), 0},
+		{udpPacket(0x800, 17, 0x20, 53), 0},
+		{udpPacket(0x800, 17, 0, 53)[:36], 0},
+		{nil, 0},
+	} {
+		if r := vm.Run(c.packet, uint32(len(c.packet))); r != c.expected {
+			t.Errorf("%x: %d", c.packet, r)
+		}
+	}
+	// The source port matches as well
+	p := udpPacket(0x800, 17, 0, 80)
+	p[34], p[35] = 0, 53
+	if !vm.Matches(p) {
+		t.Error(p)
+	}
+}
+
+func TestRunArithmetic(t *testing.T) {
+	for _, c := range []struct {
+		code     []string
+		expected uint32
+	}{
+		{[]string{
+			"(000) ld       #pktlen",
+			"(001) ret      ",
+		}, 1000},
+		{[]string{
+			"(000) ldx      #pktlen",
+			"(001) txa      ",
+			"(002) ret      ",
+		}, 1000},
+		{[]string{
+			"(000) ld       #0x7",
+			"(001) add      #3",
+			"(002) mul      #4",
+			"(003) ret      ",
+		}, 40},
+		{[]string{
+			"(000) ld       #0x7",
+			"(001) sub      #8",
+			"(002) ret      ",
+		}, 0xffffffff},
+		{[]string{
+			"(000) ld       #0x7",
+			"(001) div      #2",
+			"(002) ret      ",
+		}, 3},
+		{[]string{
+			"(000) ld       #0x7",
+			"(001) mod      #4",
+			"(002) ret      ",
+		}, 3},
+		{[]string{
+			"(000) ld       #0x6",
+			"(001) and      #0x3",
+			"(002) or       #0x8",
+			"(003) ret      ",
+		}, 10},
+		{[]string{
+			"(000) ld       #0x6",
+			"(001) xor      #0x3",
+			"(002) lsh      #4",
+			"(003) rsh      #1",
+			"(004) ret      ",
+		}, 40},
+		{[]string{
+			"(000) ld       #0x1",
+			"(001) neg      ",
+			"(002) ret      ",
+		}, 0xffffffff},
+		{[]string{
+			"(000) ldx      #0x0",
+			"(001) div      x",
+			"(002) ret      #1",
+		}, 0},
+		{[]string{
+			"(000) ld       #0x5",
+			"(001) st       M[4]",
+			"(002) ldx      M[4]",
+			"(003) ret      x",
+		}, 5},
+		{[]string{
+			"(000) ldx      #0x5",
+			"(001) stx      M[4]",
+			"(002) ld       M[4]",
+			"(003) ret      ",
+		}, 5},
+		{[]string{
+			"(000) ld       #0x5",
+			"(001) tax      ",
+			"(002) add      x",
+			"(003) ret      ",
+		}, 10},
+		{[]string{
+			"(000) ldx      #0xffffffff",
+			"(001) ldb      [x + 2]",
+			"(002) ret      #1",
+		}, 0},
+		{[]string{
+			"(000) ldx      #0x4",
+			"(001) ld       [x + 0]",
+			"(002) ret      ",
+		}, 0x05060708},
+		{[]string{
+			"(000) ld       [0]",
+			"(001) jgt      #0x1020304       jt 2\tjf 3",
+			"(002) ret      #1",
+			"(003) ret      #2",
+		}, 2},
+		{[]string{
+			"(000) ld       [0]",
+			"(001) jge      #0x1020304       jt 2\tjf 3",
+			"(002) ret      #1",
+			"(003) ret      #2",
+		}, 1},
+		{[]string{
+			"(000) ldb      [1]",
+			"(001) jset     #0x1             jt 2\tjf 3",
+			"(002) ret      #1",
+			"(003) ret      #2",
+		}, 2},
+		{[]string{
+			"(000) ldx      #0x2",
+			"(001) ldb      [1]",
+			"(002) jeq      x                jt 3\tjf 4",
+			"(003) ret      #1",
+			"(004) ret      #2",
+		}, 1},
+		{[]string{
+			"(000) ja       2",
+			"(001) ret      #1",
+			"(002) ret      #2",
+		}, 2},
+		{[]string{
+			"(000) ldxb     4*([0]&0xf)",
+			"(001) txa      ",
+			"(002) ret      ",
+		}, 4},
+	} {
+		prog, err := Parse(strings.Join(c.code, "\n"))
+		if err != nil {
+			t.Fatal(c.code, err)
+		}
+		vm, err := NewVM(prog)
+		if err != nil {
+			t.Fatal(c.code, err)
+		}
+		if r := vm.Run([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 1000); r != c.expected {
+			t.Errorf("%q: %d", c.code, r)
+		}
+	}
+}
+
+func TestRunCapfile(t *testing.T) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{0xa1b2c3d4})
+	binary.Write(&b, binary.LittleEndian, []uint16{2, 4})
+	binary.Write(&b, binary.LittleEndian, []uint32{0, 0, 65535, 1})
+	for _, port := range []uint16{53, 80, 53} {
+		p := udpPacket(0x800, 17, 0, port)
+		binary.Write(&b, binary.LittleEndian, []uint32{1400000000, 0, uint32(len(p)), uint32(len(p))})
+		b.Write(p)
+	}
+
+	prog, _ := Parse(dnsFilter)
+	vm, _ := NewVM(prog)
+	r := capfile.NewReader(&b)
+	var matched int
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vm.Run(p.Data, p.OrigLen) != 0 {
+			matched++
+		}
+	}
+	if matched != 2 {
+		t.Error(matched)
+	}
+}
@@ -0,0 +1,226 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidProgram is returned by NewVM if a program can't be executed.
+var ErrInvalidProgram = errors.New("bpf: invalid program")
+
+// VM executes a classic BPF program on packet data the same way libpcap does.
+type VM struct {
+	prog []Instruction
+}
+
+// NewVM returns a VM for the given program after checking that it is valid:
+// The program must not be empty, all instructions must be known, all jumps
+// must stay within the program, all references to scratch memory must be in
+// range and the last instruction must be a return.
+func NewVM(prog []Instruction) (*VM, error) {
+	if len(prog) == 0 {
+		return nil, fmt.Errorf("%w: empty program", ErrInvalidProgram)
+	}
+	for n, ins := range prog {
+		if err := ins.validate(n, len(prog)); err != nil {
+			return nil, fmt.Errorf("%w: instruction %d: %s", ErrInvalidProgram, n, err)
+		}
+	}
+	if prog[len(prog)-1].Class() != ClassRET {
+		return nil, fmt.Errorf("%w: last instruction is not a return", ErrInvalidProgram)
+	}
+	return &VM{prog: prog}, nil
+}
+
+// validate checks the instruction at index n of a program of the given length.
+func (i Instruction) validate(n, length int) error {
+	// Known opcodes survive being disassembled and assembled again
+	if i.Class() == ClassJMP && i.Op&0xf0 == OpJA {
+		if i.Op != ClassJMP|OpJA {
+			return fmt.Errorf("unknown opcode 0x%x", i.Op)
+		}
+	} else if a, err := assemble(i.disassemble(n)); err != nil || a.Op != i.Op {
+		return fmt.Errorf("unknown opcode 0x%x", i.Op)
+	}
+	switch i.Class() {
+	case ClassLD, ClassLDX:
+		if i.Op&0xe0 == ModeMEM && i.K >= MemWords {
+			return fmt.Errorf("scratch memory index %d out of range", i.K)
+		}
+	case ClassST, ClassSTX:
+		if i.K >= MemWords {
+			return fmt.Errorf("scratch memory index %d out of range", i.K)
+		}
+	case ClassALU:
+		switch i.Op & 0xf8 {
+		case OpDIV | SrcK, OpMOD | SrcK:
+			if i.K == 0 {
+				return errors.New("division by zero")
+			}
+		}
+	case ClassJMP:
+		if i.Op&0xf0 == OpJA {
+			if uint64(n)+1+uint64(i.K) >= uint64(length) {
+				return errors.New("jump out of range")
+			}
+		} else if n+1+int(i.Jt) >= length || n+1+int(i.Jf) >= length {
+			return errors.New("jump out of range")
+		}
+	}
+	return nil
+}
+
+// load reads size bytes at the given offset; ok is false if the packet is too
+// short.
+func load(data []byte, offset uint32, size uint16) (v uint32, ok bool) {
+	n := map[uint16]uint32{SizeW: 4, SizeH: 2, SizeB: 1}[size]
+	if uint64(offset)+uint64(n) > uint64(len(data)) {
+		return 0, false
+	}
+	switch size {
+	case SizeW:
+		return binary.BigEndian.Uint32(data[offset:]), true
+	case SizeH:
+		return uint32(binary.BigEndian.Uint16(data[offset:])), true
+	default:
+		return uint32(data[offset]), true
+	}
+}
+
+// Run executes the program on the given packet data, of which wireLen bytes
+// were seen on the wire; wireLen is what "ld #pktlen" loads. Returns the
+// number of bytes of the packet to accept, zero if the packet is rejected.
+// Like in libpcap, loads beyond the end of data and divisions by zero reject
+// the packet.
+func (vm *VM) Run(data []byte, wireLen uint32) uint32 {
+	var a, x uint32
+	var mem [MemWords]uint32
+	for pc := 0; pc < len(vm.prog); pc++ {
+		ins := vm.prog[pc]
+		switch ins.Class() {
+		case ClassLD:
+			switch ins.Op & 0xe0 {
+			case ModeABS, ModeIND:
+				offset := ins.K
+				if ins.Op&0xe0 == ModeIND {
+					offset += x
+					if offset < x {
+						return 0
+					}
+				}
+				v, ok := load(data, offset, ins.Op&0x18)
+				if !ok {
+					return 0
+				}
+				a = v
+			case ModeLEN:
+				a = wireLen
+			case ModeMEM:
+				a = mem[ins.K]
+			default:
+				a = ins.K
+			}
+		case ClassLDX:
+			switch ins.Op & 0xe0 {
+			case ModeLEN:
+				x = wireLen
+			case ModeMEM:
+				x = mem[ins.K]
+			case ModeMSH:
+				v, ok := load(data, ins.K, SizeB)
+				if !ok {
+					return 0
+				}
+				x = 4 * (v & 0xf)
+			default:
+				x = ins.K
+			}
+		case ClassST:
+			mem[ins.K] = a
+		case ClassSTX:
+			mem[ins.K] = x
+		case ClassALU:
+			operand := ins.K
+			if ins.Op&SrcX != 0 {
+				operand = x
+			}
+			switch ins.Op & 0xf0 {
+			case OpADD:
+				a += operand
+			case OpSUB:
+				a -= operand
+			case OpMUL:
+				a *= operand
+			case OpDIV:
+				if operand == 0 {
+					return 0
+				}
+				a /= operand
+			case OpMOD:
+				if operand == 0 {
+					return 0
+				}
+				a %= operand
+			case OpAND:
+				a &= operand
+			case OpOR:
+				a |= operand
+			case OpXOR:
+				a ^= operand
+			case OpLSH:
+				a <<= operand
+			case OpRSH:
+				a >>= operand
+			case OpNEG:
+				a = -a
+			}
+		case ClassJMP:
+			if ins.Op&0xf0 == OpJA {
+				pc += int(ins.K)
+				continue
+			}
+			operand := ins.K
+			if ins.Op&SrcX != 0 {
+				operand = x
+			}
+			var cond bool
+			switch ins.Op & 0xf0 {
+			case OpJEQ:
+				cond = a == operand
+			case OpJGT:
+				cond = a > operand
+			case OpJGE:
+				cond = a >= operand
+			case OpJSET:
+				cond = a&operand != 0
+			}
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case ClassRET:
+			switch ins.Op & 0x18 {
+			case SrcA:
+				return a
+			case SrcX:
+				return x
+			}
+			return ins.K
+		case ClassMISC:
+			if ins.Op&0xf8 == MiscTXA {
+				a = x
+			} else {
+				x = a
+			}
+		}
+	}
+	return 0
+}
+
+// Matches returns true if the program accepts the given packet, assuming it
+// was captured completely.
+func (vm *VM) Matches(data []byte) bool {
+	return vm.Run(data, uint32(len(data))) != 0
+}
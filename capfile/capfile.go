@@ -0,0 +1,300 @@
+/* Dumpcap interface for golang
+Copyright (C) 2014 Lukas Lueg, lukas.lueg@gmail.com
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation; either version 3 of the License, or (at your option) any later
+version.
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+You should have received a copy of the GNU General Public License along with
+this program; if not, write to the Free Software Foundation, Inc., 51 Franklin
+Street, Fifth Floor, Boston, MA 02110-1301  USA
+*/
+
+/*
+Package capfile reads the PCAP and PCAP-ng files written by dumpcap without
+the need for libpcap.
+A Reader may be used on files which are still being written to: If a packet
+is not completely available yet, no input is consumed and the Reader can be
+asked again later on. This allows to read exactly the number of packets
+dumpcap reports in it's PacketCountMsg-messages.
+*/
+package capfile
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"time"
+)
+
+// Format is the file format of a capture file.
+type Format uint8
+
+// Known file formats
+const (
+	UnknownFormat Format = iota
+	PCAP                 // Classic libpcap format
+	PCAPNG               // PCAP next generation
+)
+
+func (f Format) String() string {
+	switch f {
+	case PCAP:
+		return "PCAP"
+	case PCAPNG:
+		return "PCAP-ng"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+var (
+	// ErrUnknownFormat is returned if the input is neither PCAP nor PCAP-ng.
+	ErrUnknownFormat = errors.New("capfile: unknown file format")
+	// ErrMalformed is returned if the input violates the file format.
+	ErrMalformed = errors.New("capfile: malformed capture file")
+	// ErrUnknownInterface is returned if a packet refers to an interface that
+	// was not described before.
+	ErrUnknownInterface = errors.New("capfile: packet refers to unknown interface")
+)
+
+// The maximum number of bytes a single record may occupy
+const maxRecordSize = 64 << 20
+
+// The number of bytes read from the input at once
+const readSize = 64 << 10
+
+// The number of reads returning neither data nor an error before giving up
+const maxEmptyReads = 100
+
+// Packet represents a single packet read from a capture file.
+type Packet struct {
+	Timestamp      time.Time // The time the packet was captured; zero if unknown
+	InterfaceIndex int       // The index of the interface in Reader.Interfaces()
+	CapLen         uint32    // The number of bytes captured, which is len(Data)
+	OrigLen        uint32    // The length of the packet as seen on the wire
+	Data           []byte    // The packet data
+}
+
+// Interface describes an interface packets were captured on.
+type Interface struct {
+	LinkType    uint16 // The link-layer type, e.g. 1 for ethernet
+	SnapLen     uint32 // The maximum number of bytes captured per packet, 0 if unlimited
+	Name        string // The name of the device, if known
+	Description string // The description of the device, if known
+	Statistics  *InterfaceStatistics
+
+	unitsPerSecond uint64 // timestamp resolution
+	tsOffset       int64  // seconds added to every timestamp
+}
+
+// timestamp converts a timestamp given in the interface's resolution.
+func (i *Interface) timestamp(ts uint64) time.Time {
+	sec, frac := ts/i.unitsPerSecond, ts%i.unitsPerSecond
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, i.unitsPerSecond)
+	return time.Unix(int64(sec)+i.tsOffset, int64(nsec))
+}
+
+// InterfaceStatistics is reported by dumpcap when it finishes capturing on
+// an interface. Counters dumpcap did not report are zero.
+type InterfaceStatistics struct {
+	Timestamp      time.Time // The time the statistics were taken
+	StartTime      time.Time // The time the capture started
+	EndTime        time.Time // The time the capture ended
+	Received       uint64    // The number of packets received by the interface
+	Dropped        uint64    // The number of packets dropped by the interface
+	FilterAccepted uint64    // The number of packets accepted by the capture filter
+	OSDropped      uint64    // The number of packets dropped by the operating system
+	Delivered      uint64    // The number of packets delivered to dumpcap
+}
+
+// NameRecord associates an address with the names it resolved to.
+type NameRecord struct {
+	Addr  net.IP
+	Names []string
+}
+
+// Reader reads packets from a PCAP or PCAP-ng stream.
+type Reader struct {
+	r      io.Reader
+	buf    []byte // bytes read from r but not consumed yet
+	off    int    // offset of the first unconsumed byte in buf
+	err    error  // sticky error other than EOF
+	format Format
+	order  binary.ByteOrder
+	ifaces []Interface
+	names  []NameRecord
+}
+
+// NewReader creates a Reader for the given input. The input is not read until
+// Next() is called.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// The first bytes of a gzip-compressed file
+var gzipMagic = [2]byte{0x1f, 0x8b}
+
+// gzipFile closes the file when the decompressor is closed.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	err := g.Reader.Close()
+	if ferr := g.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// Open opens the named file for reading. Files compressed using gzip, like
+// the ringbuffer files dumpcap compresses, are decompressed transparently;
+// such files can't be followed while they are being written to.
+func Open(name string) (*Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var magic [2]byte
+	n, err := io.ReadFull(f, magic[:])
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if n == len(magic) && magic == gzipMagic {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return NewReader(gzipFile{zr, f}), nil
+	}
+	return NewReader(f), nil
+}
+
+// Close closes the underlying input if it is an io.Closer.
+func (r *Reader) Close() error {
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Format returns the file format of the input, which is UnknownFormat until
+// the file header was read.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Interfaces returns the interfaces described in the current section of the
+// file so far.
+func (r *Reader) Interfaces() []Interface {
+	return append([]Interface(nil), r.ifaces...)
+}
+
+// Names returns the name resolution records found in the current section of
+// the file so far.
+func (r *Reader) Names() []NameRecord {
+	return append([]NameRecord(nil), r.names...)
+}
+
+// Next returns the next packet. Records which do not contain packets are
+// processed and skipped.
+// Next returns io.EOF if the input ends before the next packet starts and
+// io.ErrUnexpectedEOF if it ends within a packet; io.ErrNoProgress is returned
+// if the input repeatedly provides no data without reporting an error. In all
+// these cases no input is consumed: If the input is a file which is still
+// being written to, Next may be called again once more data is available.
+func (r *Reader) Next() (*Packet, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	for {
+		var p *Packet
+		var err error
+		switch r.format {
+		case UnknownFormat:
+			err = r.readHeader()
+		case PCAP:
+			p, err = r.nextPCAP()
+		case PCAPNG:
+			p, err = r.nextBlock()
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != io.ErrNoProgress {
+				r.err = err
+			}
+			return nil, err
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+}
+
+// readHeader determines the file format.
+func (r *Reader) readHeader() error {
+	b, err := r.peek(4)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(b) == blockTypeSHB {
+		r.format = PCAPNG
+		return nil
+	}
+	return r.readPCAPHeader()
+}
+
+// peek returns the next n bytes without consuming them. Returns io.EOF if
+// no bytes are available at all and io.ErrUnexpectedEOF if less than n bytes
+// are available.
+func (r *Reader) peek(n int) ([]byte, error) {
+	for len(r.buf)-r.off < n {
+		if r.off > 0 {
+			r.buf = r.buf[:copy(r.buf, r.buf[r.off:])]
+			r.off = 0
+		}
+		if cap(r.buf)-len(r.buf) < readSize {
+			buf := make([]byte, len(r.buf), 2*cap(r.buf)+readSize)
+			copy(buf, r.buf)
+			r.buf = buf
+		}
+		var m int
+		var err error
+		// Like bufio, tolerate readers which occasionally return no data
+		// and no error
+		for i := 0; i < maxEmptyReads && m == 0 && err == nil; i++ {
+			m, err = r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		}
+		r.buf = r.buf[:len(r.buf)+m]
+		if m > 0 {
+			continue
+		}
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		if err == io.EOF && len(r.buf) > r.off {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return r.buf[r.off : r.off+n], nil
+}
+
+// consume discards n bytes which were peek()ed before.
+func (r *Reader) consume(n int) {
+	r.off += n
+}
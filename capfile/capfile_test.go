@@ -0,0 +1,354 @@
+package capfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var packetData = []byte("this is a packet")
+
+func pcapFile(order binary.ByteOrder, magic uint32, frac uint32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, order, []uint32{magic})
+	binary.Write(&b, order, []uint16{2, 4})
+	binary.Write(&b, order, []uint32{0, 0, 65535, 1})
+	binary.Write(&b, order, []uint32{1400000000, frac, uint32(len(packetData)), 100})
+	b.Write(packetData)
+	return b.Bytes()
+}
+
+// pcapngBlock encodes a block of the given type and body.
+func pcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	var b bytes.Buffer
+	body = append(body, make([]byte, pad(len(body))-len(body))...)
+	binary.Write(&b, order, []uint32{blockType, uint32(len(body) + 12)})
+	b.Write(body)
+	binary.Write(&b, order, uint32(len(body)+12))
+	return b.Bytes()
+}
+
+// pcapngOption encodes a single option.
+func pcapngOption(order binary.ByteOrder, code uint16, value []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, order, []uint16{code, uint16(len(value))})
+	b.Write(value)
+	b.Write(make([]byte, pad(len(value))-len(value)))
+	return b.Bytes()
+}
+
+func pcapngFile(order binary.ByteOrder) []byte {
+	var b, body bytes.Buffer
+
+	binary.Write(&body, order, byteOrderMagic)
+	binary.Write(&body, order, []uint16{1, 0})
+	binary.Write(&body, order, int64(-1))
+	b.Write(pcapngBlock(order, blockTypeSHB, body.Bytes()))
+
+	// First interface with nanosecond resolution and a name
+	body.Reset()
+	binary.Write(&body, order, []uint16{1, 0})
+	binary.Write(&body, order, uint32(8))
+	body.Write(pcapngOption(order, optIfName, []byte("eth0")))
+	body.Write(pcapngOption(order, optIfTSResol, []byte{9}))
+	body.Write(pcapngOption(order, optEndOfOpt, nil))
+	b.Write(pcapngBlock(order, blockTypeIDB, body.Bytes()))
+
+	// Second interface with default resolution
+	body.Reset()
+	binary.Write(&body, order, []uint16{101, 0})
+	binary.Write(&body, order, uint32(0))
+	b.Write(pcapngBlock(order, blockTypeIDB, body.Bytes()))
+
+	// Unknown blocks are skipped
+	b.Write(pcapngBlock(order, 0x0bad, []byte("foobar")))
+
+	ts := uint64(1400000000123456789)
+	body.Reset()
+	binary.Write(&body, order, []uint32{0, uint32(ts >> 32), uint32(ts),
+		uint32(len(packetData)), 100})
+	body.Write(packetData)
+	b.Write(pcapngBlock(order, blockTypeEPB, body.Bytes()))
+
+	// Truncated by the interface's snaplen
+	body.Reset()
+	binary.Write(&body, order, uint32(len(packetData)))
+	body.Write(packetData)
+	b.Write(pcapngBlock(order, blockTypeSPB, body.Bytes()))
+
+	ts = uint64(1400000000123456)
+	body.Reset()
+	binary.Write(&body, order, []uint32{1, uint32(ts >> 32), uint32(ts),
+		uint32(len(packetData)), uint32(len(packetData))})
+	body.Write(packetData)
+	b.Write(pcapngBlock(order, blockTypeEPB, body.Bytes()))
+
+	body.Reset()
+	record := append(net.IPv4(127, 0, 0, 1).To4(), []byte("localhost\x00lo\x00")...)
+	body.Write(pcapngOption(order, nrbRecordIPv4, record))
+	body.Write(pcapngOption(order, nrbRecordEnd, nil))
+	b.Write(pcapngBlock(order, blockTypeNRB, body.Bytes()))
+
+	body.Reset()
+	binary.Write(&body, order, []uint32{1, uint32(ts >> 32), uint32(ts)})
+	var counter [8]byte
+	order.PutUint64(counter[:], 42)
+	body.Write(pcapngOption(order, optISBIfRecv, counter[:]))
+	order.PutUint64(counter[:], 7)
+	body.Write(pcapngOption(order, optISBIfDrop, counter[:]))
+	body.Write(pcapngOption(order, optEndOfOpt, nil))
+	b.Write(pcapngBlock(order, blockTypeISB, body.Bytes()))
+
+	return b.Bytes()
+}
+
+func TestPCAP(t *testing.T) {
+	for _, tc := range []struct {
+		order binary.ByteOrder
+		magic uint32
+		frac  uint32
+		nsec  int
+	}{
+		{binary.LittleEndian, pcapMagicMicroseconds, 123456, 123456000},
+		{binary.BigEndian, pcapMagicMicroseconds, 123456, 123456000},
+		{binary.LittleEndian, pcapMagicNanoseconds, 123456789, 123456789},
+		{binary.BigEndian, pcapMagicNanoseconds, 123456789, 123456789},
+	} {
+		r := NewReader(bytes.NewReader(pcapFile(tc.order, tc.magic, tc.frac)))
+		p, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Format() != PCAP || len(r.Interfaces()) != 1 || r.Interfaces()[0].LinkType != 1 ||
+			r.Interfaces()[0].SnapLen != 65535 {
+			t.Error(r.Format(), r.Interfaces())
+		}
+		if p.Timestamp.Unix() != 1400000000 || p.Timestamp.Nanosecond() != tc.nsec ||
+			p.InterfaceIndex != 0 || p.CapLen != uint32(len(packetData)) ||
+			p.OrigLen != 100 || !bytes.Equal(p.Data, packetData) {
+			t.Error(p)
+		}
+		if p, err = r.Next(); err != io.EOF {
+			t.Error(p, err)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.pcap")
+	if err := os.WriteFile(plain, pcapFile(binary.LittleEndian, pcapMagicMicroseconds, 0), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(pcapngFile(binary.BigEndian))
+	zw.Close()
+	compressed := filepath.Join(dir, "compressed.pcapng.gz")
+	if err := os.WriteFile(compressed, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.pcapng")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		format Format
+	}{
+		{plain, PCAP},
+		{compressed, PCAPNG},
+	} {
+		r, err := Open(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := r.Next(); err != nil || !bytes.Equal(p.Data, packetData) {
+			t.Error(tc.name, p, err)
+		}
+		if r.Format() != tc.format {
+			t.Error(tc.name, r.Format())
+		}
+		if err = r.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A file which was not written to yet is not mistaken for anything
+	r, err := Open(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := r.Next(); err != io.EOF {
+		t.Error(p, err)
+	}
+	r.Close()
+
+	if _, err = Open(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
+
+func TestPCAPNG(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		r := NewReader(bytes.NewReader(pcapngFile(order)))
+
+		p, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Format() != PCAPNG {
+			t.Error(r.Format())
+		}
+		if p.Timestamp.Unix() != 1400000000 || p.Timestamp.Nanosecond() != 123456789 ||
+			p.InterfaceIndex != 0 || p.OrigLen != 100 || !bytes.Equal(p.Data, packetData) {
+			t.Error(p)
+		}
+
+		p, err = r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Timestamp.IsZero() || p.CapLen != 8 || p.OrigLen != uint32(len(packetData)) ||
+			!bytes.Equal(p.Data, packetData[:8]) {
+			t.Error(p)
+		}
+
+		p, err = r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Timestamp.Unix() != 1400000000 || p.Timestamp.Nanosecond() != 123456000 ||
+			p.InterfaceIndex != 1 || !bytes.Equal(p.Data, packetData) {
+			t.Error(p)
+		}
+
+		if p, err = r.Next(); err != io.EOF {
+			t.Error(p, err)
+		}
+
+		ifaces := r.Interfaces()
+		if len(ifaces) != 2 || ifaces[0].Name != "eth0" || ifaces[0].SnapLen != 8 ||
+			ifaces[1].LinkType != 101 || ifaces[0].Statistics != nil {
+			t.Error(ifaces)
+		}
+		if s := ifaces[1].Statistics; s == nil || s.Received != 42 || s.Dropped != 7 ||
+			s.Timestamp.Nanosecond() != 123456000 {
+			t.Error(s)
+		}
+		names := r.Names()
+		if len(names) != 1 || !names[0].Addr.Equal(net.IPv4(127, 0, 0, 1)) ||
+			len(names[0].Names) != 2 || names[0].Names[1] != "lo" {
+			t.Error(names)
+		}
+	}
+}
+
+// growingReader returns io.EOF once all data appended so far was read.
+type growingReader struct {
+	data []byte
+}
+
+func (g *growingReader) Read(b []byte) (int, error) {
+	if len(g.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, g.data)
+	g.data = g.data[n:]
+	return n, nil
+}
+
+func TestFollow(t *testing.T) {
+	file := pcapngFile(binary.LittleEndian)
+	g := &growingReader{}
+	r := NewReader(g)
+
+	var packets int
+	var eofs int
+	for i := range file {
+		g.data = append(g.data, file[i])
+		p, err := r.Next()
+		switch err {
+		case nil:
+			packets++
+			if p.CapLen == 0 {
+				t.Error(p)
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			eofs++
+		default:
+			t.Fatal(err)
+		}
+	}
+	if packets != 3 || eofs != len(file)-3 {
+		t.Error(packets, eofs)
+	}
+}
+
+// emptyReader returns neither data nor an error for the given number of reads
+// before reading from r.
+type emptyReader struct {
+	empty int
+	r     io.Reader
+}
+
+func (e *emptyReader) Read(b []byte) (int, error) {
+	if e.empty > 0 {
+		e.empty--
+		return 0, nil
+	}
+	return e.r.Read(b)
+}
+
+func TestEmptyReads(t *testing.T) {
+	file := pcapFile(binary.LittleEndian, 0xa1b2c3d4, 1)
+	r := NewReader(&emptyReader{empty: 1, r: bytes.NewReader(file)})
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader which keeps returning nothing is not given up on
+	e := &emptyReader{empty: 2 * maxEmptyReads, r: bytes.NewReader(file)}
+	r = NewReader(e)
+	if _, err := r.Next(); err != io.ErrNoProgress {
+		t.Fatal(err)
+	}
+	e.empty = 0
+	if _, err := r.Next(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte("foobar, this is not a capture file")))
+	if _, err := r.Next(); err != ErrUnknownFormat {
+		t.Error(err)
+	}
+	if _, err := r.Next(); err != ErrUnknownFormat {
+		t.Error("errors should be sticky", err)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	file := pcapngFile(binary.LittleEndian)
+	// Corrupt the trailing length of the Section Header Block
+	file[27]++
+	r := NewReader(bytes.NewReader(file))
+	if _, err := r.Next(); err != ErrMalformed {
+		t.Error(err)
+	}
+}
+
+func TestTimestampResolution(t *testing.T) {
+	iface := Interface{unitsPerSecond: 1 << 10}
+	if ts := iface.timestamp(3<<10 + 512); ts.Unix() != 3 || ts.Nanosecond() != int(time.Second/2) {
+		t.Error(ts)
+	}
+}
@@ -0,0 +1,80 @@
+package capfile
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Magic numbers of classic PCAP files
+const (
+	pcapMagicMicroseconds uint32 = 0xa1b2c3d4
+	pcapMagicNanoseconds         = 0xa1b23c4d
+)
+
+// Size of the file header and the per-packet header
+const (
+	pcapFileHeaderSize   = 24
+	pcapRecordHeaderSize = 16
+)
+
+// readPCAPHeader decodes the file header of a classic PCAP file, which
+// describes the only interface.
+func (r *Reader) readPCAPHeader() error {
+	b, err := r.peek(pcapFileHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	iface := Interface{unitsPerSecond: uint64(time.Second / time.Microsecond)}
+	switch {
+	case binary.LittleEndian.Uint32(b) == pcapMagicMicroseconds:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(b) == pcapMagicMicroseconds:
+		r.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(b) == pcapMagicNanoseconds:
+		r.order = binary.LittleEndian
+		iface.unitsPerSecond = uint64(time.Second)
+	case binary.BigEndian.Uint32(b) == pcapMagicNanoseconds:
+		r.order = binary.BigEndian
+		iface.unitsPerSecond = uint64(time.Second)
+	default:
+		return ErrUnknownFormat
+	}
+	iface.SnapLen = r.order.Uint32(b[16:20])
+	// The upper bits of the link-type carry FCS-information
+	iface.LinkType = uint16(r.order.Uint32(b[20:24]))
+
+	r.consume(pcapFileHeaderSize)
+	r.format = PCAP
+	r.ifaces = []Interface{iface}
+	return nil
+}
+
+// nextPCAP decodes the next packet from a classic PCAP file.
+func (r *Reader) nextPCAP() (*Packet, error) {
+	b, err := r.peek(pcapRecordHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	sec := r.order.Uint32(b[0:4])
+	frac := r.order.Uint32(b[4:8])
+	capLen := r.order.Uint32(b[8:12])
+	origLen := r.order.Uint32(b[12:16])
+	if capLen > maxRecordSize {
+		return nil, ErrMalformed
+	}
+
+	b, err = r.peek(pcapRecordHeaderSize + int(capLen))
+	if err != nil {
+		return nil, err
+	}
+	iface := &r.ifaces[0]
+	p := &Packet{
+		Timestamp: iface.timestamp(uint64(sec)*iface.unitsPerSecond + uint64(frac)),
+		CapLen:    capLen,
+		OrigLen:   origLen,
+		Data:      append([]byte(nil), b[pcapRecordHeaderSize:]...),
+	}
+	r.consume(pcapRecordHeaderSize + int(capLen))
+	return p, nil
+}
@@ -0,0 +1,368 @@
+package capfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Block types of PCAP-ng files
+const (
+	blockTypeIDB uint32 = 0x00000001 // Interface Description Block
+	blockTypeOPB        = 0x00000002 // (Obsolete) Packet Block
+	blockTypeSPB        = 0x00000003 // Simple Packet Block
+	blockTypeNRB        = 0x00000004 // Name Resolution Block
+	blockTypeISB        = 0x00000005 // Interface Statistics Block
+	blockTypeEPB        = 0x00000006 // Enhanced Packet Block
+	blockTypeSHB        = 0x0a0d0d0a // Section Header Block
+)
+
+// The magic number found in the Section Header Block
+const byteOrderMagic uint32 = 0x1a2b3c4d
+
+// Option codes of Interface Description Blocks
+const (
+	optIfName        uint16 = 2
+	optIfDescription        = 3
+	optIfTSResol            = 9
+	optIfTSOffset           = 14
+)
+
+// Option codes of Interface Statistics Blocks
+const (
+	optISBStartTime    uint16 = 2
+	optISBEndTime             = 3
+	optISBIfRecv              = 4
+	optISBIfDrop              = 5
+	optISBFilterAccept        = 6
+	optISBOSDrop              = 7
+	optISBUsrDeliv            = 8
+)
+
+// Record types of Name Resolution Blocks
+const (
+	nrbRecordEnd  uint16 = 0
+	nrbRecordIPv4        = 1
+	nrbRecordIPv6        = 2
+)
+
+// The option code terminating a list of options
+const optEndOfOpt uint16 = 0
+
+// pad rounds n up to a multiple of four.
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+// nextBlock decodes the next block from a PCAP-ng file. Returns a nil Packet
+// for blocks which do not contain a packet.
+func (r *Reader) nextBlock() (*Packet, error) {
+	b, err := r.peek(8)
+	if err != nil {
+		return nil, err
+	}
+	blockType := binary.LittleEndian.Uint32(b)
+	if blockType == blockTypeSHB {
+		// The byte order may change with every section
+		if b, err = r.peek(12); err != nil {
+			return nil, err
+		}
+		switch byteOrderMagic {
+		case binary.LittleEndian.Uint32(b[8:12]):
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(b[8:12]):
+			r.order = binary.BigEndian
+		default:
+			return nil, ErrMalformed
+		}
+	} else if r.order == nil {
+		// The file has to start with a Section Header Block
+		return nil, ErrMalformed
+	}
+	blockType = r.order.Uint32(b[0:4])
+	blockLen := int(r.order.Uint32(b[4:8]))
+	if blockLen < 12 || blockLen%4 != 0 || blockLen > maxRecordSize {
+		return nil, ErrMalformed
+	}
+
+	if b, err = r.peek(blockLen); err != nil {
+		return nil, err
+	}
+	if int(r.order.Uint32(b[blockLen-4:])) != blockLen {
+		return nil, ErrMalformed
+	}
+	body := b[8 : blockLen-4]
+
+	var p *Packet
+	switch blockType {
+	case blockTypeSHB:
+		err = r.readSHB(body)
+	case blockTypeIDB:
+		err = r.readIDB(body)
+	case blockTypeEPB:
+		p, err = r.readEPB(body)
+	case blockTypeSPB:
+		p, err = r.readSPB(body)
+	case blockTypeOPB:
+		p, err = r.readOPB(body)
+	case blockTypeNRB:
+		err = r.readNRB(body)
+	case blockTypeISB:
+		err = r.readISB(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.consume(blockLen)
+	return p, nil
+}
+
+// readOptions calls f for every option in b.
+func (r *Reader) readOptions(b []byte, f func(code uint16, value []byte) error) error {
+	for len(b) >= 4 {
+		code := r.order.Uint16(b[0:2])
+		n := int(r.order.Uint16(b[2:4]))
+		if code == optEndOfOpt {
+			return nil
+		}
+		if 4+n > len(b) {
+			return ErrMalformed
+		}
+		if err := f(code, b[4:4+n]); err != nil {
+			return err
+		}
+		if 4+pad(n) > len(b) {
+			return nil
+		}
+		b = b[4+pad(n):]
+	}
+	return nil
+}
+
+// readSHB starts a new section, forgetting about all previous interfaces.
+func (r *Reader) readSHB(body []byte) error {
+	if len(body) < 16 {
+		return ErrMalformed
+	}
+	if major := r.order.Uint16(body[4:6]); major != 1 {
+		return ErrMalformed
+	}
+	r.ifaces = nil
+	r.names = nil
+	return nil
+}
+
+// readIDB adds a new interface to the current section.
+func (r *Reader) readIDB(body []byte) error {
+	if len(body) < 8 {
+		return ErrMalformed
+	}
+	iface := Interface{
+		LinkType:       r.order.Uint16(body[0:2]),
+		SnapLen:        r.order.Uint32(body[4:8]),
+		unitsPerSecond: uint64(time.Second / time.Microsecond),
+	}
+	err := r.readOptions(body[8:], func(code uint16, value []byte) error {
+		switch code {
+		case optIfName:
+			iface.Name = string(value)
+		case optIfDescription:
+			iface.Description = string(value)
+		case optIfTSResol:
+			if len(value) != 1 {
+				return ErrMalformed
+			}
+			exp := uint64(value[0] & 0x7f)
+			if value[0]&0x80 != 0 {
+				if exp > 63 {
+					return ErrMalformed
+				}
+				iface.unitsPerSecond = 1 << exp
+			} else {
+				if exp > 19 {
+					return ErrMalformed
+				}
+				iface.unitsPerSecond = 1
+				for ; exp > 0; exp-- {
+					iface.unitsPerSecond *= 10
+				}
+			}
+		case optIfTSOffset:
+			if len(value) != 8 {
+				return ErrMalformed
+			}
+			iface.tsOffset = int64(r.order.Uint64(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.ifaces = append(r.ifaces, iface)
+	return nil
+}
+
+// interfaceAt returns the interface with the given index.
+func (r *Reader) interfaceAt(idx uint32) (*Interface, error) {
+	if idx >= uint32(len(r.ifaces)) {
+		return nil, ErrUnknownInterface
+	}
+	return &r.ifaces[idx], nil
+}
+
+// timestamp decodes a 64 bit timestamp stored as two 32 bit values.
+func (r *Reader) timestamp(b []byte) uint64 {
+	return uint64(r.order.Uint32(b[0:4]))<<32 | uint64(r.order.Uint32(b[4:8]))
+}
+
+// readEPB decodes an Enhanced Packet Block.
+func (r *Reader) readEPB(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, ErrMalformed
+	}
+	idx := r.order.Uint32(body[0:4])
+	iface, err := r.interfaceAt(idx)
+	if err != nil {
+		return nil, err
+	}
+	capLen := r.order.Uint32(body[12:16])
+	if int64(capLen) > int64(len(body)-20) {
+		return nil, ErrMalformed
+	}
+	return &Packet{
+		Timestamp:      iface.timestamp(r.timestamp(body[4:12])),
+		InterfaceIndex: int(idx),
+		CapLen:         capLen,
+		OrigLen:        r.order.Uint32(body[16:20]),
+		Data:           append([]byte(nil), body[20:20+capLen]...),
+	}, nil
+}
+
+// readSPB decodes a Simple Packet Block, which always refers to the first
+// interface and carries no timestamp.
+func (r *Reader) readSPB(body []byte) (*Packet, error) {
+	if len(body) < 4 {
+		return nil, ErrMalformed
+	}
+	iface, err := r.interfaceAt(0)
+	if err != nil {
+		return nil, err
+	}
+	origLen := r.order.Uint32(body[0:4])
+	capLen := origLen
+	if iface.SnapLen != 0 && capLen > iface.SnapLen {
+		capLen = iface.SnapLen
+	}
+	if int64(capLen) > int64(len(body)-4) {
+		capLen = uint32(len(body) - 4)
+	}
+	return &Packet{
+		CapLen:  capLen,
+		OrigLen: origLen,
+		Data:    append([]byte(nil), body[4:4+capLen]...),
+	}, nil
+}
+
+// readOPB decodes an obsolete Packet Block.
+func (r *Reader) readOPB(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, ErrMalformed
+	}
+	idx := uint32(r.order.Uint16(body[0:2]))
+	iface, err := r.interfaceAt(idx)
+	if err != nil {
+		return nil, err
+	}
+	capLen := r.order.Uint32(body[12:16])
+	if int64(capLen) > int64(len(body)-20) {
+		return nil, ErrMalformed
+	}
+	return &Packet{
+		Timestamp:      iface.timestamp(r.timestamp(body[4:12])),
+		InterfaceIndex: int(idx),
+		CapLen:         capLen,
+		OrigLen:        r.order.Uint32(body[16:20]),
+		Data:           append([]byte(nil), body[20:20+capLen]...),
+	}, nil
+}
+
+// readNRB decodes a Name Resolution Block.
+func (r *Reader) readNRB(body []byte) error {
+	for len(body) >= 4 {
+		recordType := r.order.Uint16(body[0:2])
+		n := int(r.order.Uint16(body[2:4]))
+		if recordType == nrbRecordEnd {
+			return nil
+		}
+		if 4+n > len(body) {
+			return ErrMalformed
+		}
+		value := body[4 : 4+n]
+
+		var addrLen int
+		switch recordType {
+		case nrbRecordIPv4:
+			addrLen = net.IPv4len
+		case nrbRecordIPv6:
+			addrLen = net.IPv6len
+		}
+		if addrLen > 0 {
+			if len(value) < addrLen {
+				return ErrMalformed
+			}
+			nr := NameRecord{Addr: append(net.IP(nil), value[:addrLen]...)}
+			for _, name := range bytes.Split(value[addrLen:], []byte{0}) {
+				if len(name) > 0 {
+					nr.Names = append(nr.Names, string(name))
+				}
+			}
+			r.names = append(r.names, nr)
+		}
+
+		if 4+pad(n) > len(body) {
+			return nil
+		}
+		body = body[4+pad(n):]
+	}
+	return nil
+}
+
+// readISB attaches the statistics to the interface they refer to.
+func (r *Reader) readISB(body []byte) error {
+	if len(body) < 12 {
+		return ErrMalformed
+	}
+	iface, err := r.interfaceAt(r.order.Uint32(body[0:4]))
+	if err != nil {
+		return err
+	}
+	stats := InterfaceStatistics{Timestamp: iface.timestamp(r.timestamp(body[4:12]))}
+	err = r.readOptions(body[12:], func(code uint16, value []byte) error {
+		if len(value) != 8 {
+			return nil
+		}
+		switch code {
+		case optISBStartTime:
+			stats.StartTime = iface.timestamp(r.timestamp(value))
+		case optISBEndTime:
+			stats.EndTime = iface.timestamp(r.timestamp(value))
+		case optISBIfRecv:
+			stats.Received = r.order.Uint64(value)
+		case optISBIfDrop:
+			stats.Dropped = r.order.Uint64(value)
+		case optISBFilterAccept:
+			stats.FilterAccepted = r.order.Uint64(value)
+		case optISBOSDrop:
+			stats.OSDropped = r.order.Uint64(value)
+		case optISBUsrDeliv:
+			stats.Delivered = r.order.Uint64(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	iface.Statistics = &stats
+	return nil
+}
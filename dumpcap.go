@@ -24,6 +24,8 @@ package dumpcap
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -31,49 +33,157 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var pipeName = "none" // TODO Windows uses a named pipe
 
-// Interface to control the dumpcap process.
-type commander interface {
+// Commander controls a single dumpcap process. The methods behave like
+// those of exec.Cmd; Wait, Run and Output should return an *ExitError if
+// dumpcap exits with a non-zero status. Dumpcap is asked to stop by sending
+// os.Interrupt and killed by sending os.Kill.
+type Commander interface {
 	Start() error
 	Run() error
 	StdoutPipe() (io.ReadCloser, error)
 	StderrPipe() (io.ReadCloser, error)
 	Wait() error
 	Output() ([]byte, error)
-	kill() error
+	Signal(sig os.Signal) error
 }
 
-// osCommand implements the commander interface via os.Exec and such
+// Runner returns the Commander used to call the given dumpcap-executable
+// using the given arguments. A Runner allows to run dumpcap differently,
+// e.g. using sudo or inside a sandbox, or to not run it at all.
+type Runner func(name string, arg ...string) Commander
+
+// osCommand implements the Commander interface via os.Exec and such
 type osCommand struct {
 	*exec.Cmd
 }
 
-func (o osCommand) kill() error {
-	return o.Process.Kill()
+// Run is like exec.Cmd.Run but returns an *ExitError if dumpcap fails.
+func (o osCommand) Run() error {
+	return newExitError(o.Cmd.Run())
+}
+
+// Wait is like exec.Cmd.Wait but returns an *ExitError if dumpcap fails.
+func (o osCommand) Wait() error {
+	return newExitError(o.Cmd.Wait())
+}
+
+// Output is like exec.Cmd.Output but returns an *ExitError if dumpcap fails.
+func (o osCommand) Output() ([]byte, error) {
+	buf, err := o.Cmd.Output()
+	return buf, newExitError(err)
+}
+
+// Signal sends the signal to dumpcap.
+func (o osCommand) Signal(sig os.Signal) error {
+	return o.Process.Signal(sig)
+}
+
+// stopChild sends an interrupt-signal to the child and waits for done to be
+// closed, which happens once all output was read. The child is killed if it
+// does not exit before the timeout or if it can't be interrupted (e.g. on
+// Windows). Returns the result of wait.
+func stopChild(child Commander, done <-chan int, timeout time.Duration, wait func() error) error {
+	if err := child.Signal(os.Interrupt); err != nil {
+		_ = child.Signal(os.Kill)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		_ = child.Signal(os.Kill)
+	}
+	return wait()
 }
 
-func newOSCommand(name string, arg ...string) commander {
+// NewOSCommand is the default Runner, which runs the given executable as a
+// child process. Runners which only change how dumpcap is run may wrap it.
+func NewOSCommand(name string, arg ...string) Commander {
 	return osCommand{Cmd: exec.Command(name, arg...)}
 }
 
 // Dumpcap allows calls to Wireshark's dumpcap tool.
+//
+// If NetNamespace is set, dumpcap is run inside that Linux network namespace
+// using nsenter. It is either the name of a namespace as created by
+// "ip netns add", the path of a namespace-file like "/proc/<pid>/ns/net" or
+// the PID of a process, e.g. a container's, whose namespace is joined. In the
+// latter case the process' user namespace is joined as well if it differs
+// from our own, so that unprivileged containers can be captured from by the
+// user owning them. All calls use the namespace, e.g. Devices() enumerates
+// the devices within it. Joining a namespace usually requires root privileges.
 type Dumpcap struct {
-	newCommand func(string, ...string) commander
-	Executable string // The name (and possibly full path) of the dumpcap-executable
+	newCommand   Runner
+	features     *featureCache
+	Executable   string // The name (and possibly full path) of the dumpcap-executable
+	NetNamespace string // If not empty, the network namespace dumpcap runs in
 }
 
 // NewDumpcap creates a new Dumpcap-struct with the Executable set to
 // "dumpcap".
 func NewDumpcap() *Dumpcap {
+	return NewDumpcapWithRunner(NewOSCommand)
+}
+
+// NewDumpcapWithRunner is like NewDumpcap but dumpcap is called using the
+// given Runner instead of NewOSCommand.
+func NewDumpcapWithRunner(runner Runner) *Dumpcap {
 	d := Dumpcap{}
-	d.newCommand = newOSCommand
+	d.newCommand = runner
+	d.features = &featureCache{}
 	d.Executable = "dumpcap"
 	return &d
 }
 
+// command returns the Commander which calls dumpcap using the given
+// arguments. If a network namespace is set, dumpcap is called via nsenter.
+func (d *Dumpcap) command(arg ...string) Commander {
+	if d.NetNamespace == "" {
+		return d.newCommand(d.Executable, arg...)
+	}
+	nsArgs := append(netNamespaceArgs(d.NetNamespace), "--", d.Executable)
+	return d.newCommand(nsenterExecutable, append(nsArgs, arg...)...)
+}
+
+// dumpcapArgs returns the arguments dumpcap itself is called with by a
+// Commander command() created using the given name and arguments.
+func dumpcapArgs(name string, arg []string) []string {
+	if name != nsenterExecutable {
+		return arg
+	}
+	for i, a := range arg {
+		if a == "--" && i+1 < len(arg) {
+			return arg[i+2:]
+		}
+	}
+	return arg
+}
+
+// netNamespaceArgs returns the arguments to nsenter for joining the given
+// network namespace.
+func netNamespaceArgs(ns string) []string {
+	if strings.ContainsRune(ns, '/') {
+		return []string{netNamespaceArg + ns}
+	}
+	if _, err := strconv.ParseUint(ns, 10, 0); err != nil {
+		return []string{netNamespaceArg + netNamespaceDir + ns}
+	}
+	args := []string{netNamespaceArg + fmt.Sprintf(procNamespaceFmt, ns, "net")}
+	userNS := fmt.Sprintf(procNamespaceFmt, ns, "user")
+	own, err1 := os.Readlink(fmt.Sprintf(procNamespaceFmt, "self", "user"))
+	their, err2 := os.Readlink(userNS)
+	if err1 == nil && err2 == nil && own != their {
+		args = append([]string{userNamespaceArg + userNS}, args...)
+	}
+	return args
+}
+
 // LinkLayerType represents the link layer a device may capture on.
 type LinkLayerType struct {
 	DLT         uint
@@ -86,17 +196,30 @@ func (llt LinkLayerType) String() string {
 	return llt.Name
 }
 
+// TimestampType represents a source of timestamps a device may use, e.g. the
+// host's clock or the network adapter's clock.
+type TimestampType struct {
+	Name        string // e.g. "host" or "adapter_unsynced"
+	Description string
+}
+
+// String returns the TimestampType's Name
+func (tt TimestampType) String() string {
+	return tt.Name
+}
+
 // Device represents an interface capable of capturing network traffic
 type Device struct {
-	DevType      DeviceType // e.g. WiredDevice or BluetoothDevice
-	Name         string     // The system-wide name e.g. "eth0"
-	Number       uint       // A unique number  // TODO Used on windows as Name can be empty there
-	VendorName   string
-	FriendlyName string
-	Addresses    []string        // Addresses the device is currently bound to
-	Loopback     bool            // True if the device is a loopback interface
-	CanRFMon     bool            // True if the device supports monitor-mode
-	LLTs         []LinkLayerType // A slice of supported link-layer types
+	DevType        DeviceType // e.g. WiredDevice or BluetoothDevice
+	Name           string     // The system-wide name e.g. "eth0"
+	Number         uint       // A unique number  // TODO Used on windows as Name can be empty there
+	VendorName     string
+	FriendlyName   string
+	Addresses      []string        // Addresses the device is currently bound to
+	Loopback       bool            // True if the device is a loopback interface
+	CanRFMon       bool            // True if the device supports monitor-mode
+	LLTs           []LinkLayerType // A slice of supported link-layer types
+	TimestampTypes []TimestampType // A slice of supported time stamp types, see Dumpcap.TimestampTypes()
 }
 
 // String returns the Device's name
@@ -106,14 +229,24 @@ func (d Device) String() string {
 
 // DeviceArgument represents device-specific arguments passed to dumpcap.
 type DeviceArgument struct {
-	CaptureFilter          string // Packet filter in libpcap filter syntax
-	DisablePromiscuousMode bool   // Don't capture in promiscuous mode
-	EnableMonitorMode      bool   // Capture in monitor mode, if available. The device may lose all connections.
-	KernelBufferSize       uint64 // Size of kernel buffer in MiB
-	LinkLayerType          string // Link layer to capture traffic on
-	Name                   string // The name of the interface
-	SnapshotLength         uint64 // Packet snapshot length
-	WiFiChannel            string // Set channel on Wifi device. Given as "<freq>,[<type>]"
+	CaptureFilter           string        // Packet filter in libpcap filter syntax
+	DisablePromiscuousMode  bool          // Don't capture in promiscuous mode
+	EnableMonitorMode       bool          // Capture in monitor mode, if available. The device may lose all connections.
+	IfDescription           string        // Description of the interface written to the capture file
+	IfName                  string        // Name of the interface written to the capture file instead of Name
+	KernelBufferSize        uint64        // Size of kernel buffer in MiB
+	LinkLayerType           string        // Link layer to capture traffic on
+	Name                    string        // The name of the interface
+	NanosecondTimestamps    bool          // Request time stamps with nanosecond instead of microsecond precision
+	RemoteCaptureOwnTraffic bool          // Don't ignore the traffic of the RPCAP connection itself
+	RemotePassword          string        // Password used with RemoteUsername
+	RemoteUDP               bool          // Use UDP for RPCAP data transfer
+	RemoteUsername          string        // Authenticate at the RPCAP server using this username and RemotePassword
+	SampleInterval          time.Duration // Capture no more than one packet per interval. Given in whole milliseconds.
+	SampleOneOf             uint64        // Capture only one of every this number of packets
+	SnapshotLength          uint64        // Packet snapshot length
+	TimestampType           string        // The name of the time stamp type to use, see Device.TimestampTypes
+	WiFiChannel             string        // Set channel on Wifi device. Given as "<freq>,[<type>]"
 }
 
 // Arguments represents global arguments passed to dumpcap for capturing
@@ -121,7 +254,9 @@ type DeviceArgument struct {
 type Arguments struct {
 	BufferedBytes          uint64           // Maximum number of bytes used for buffering packets within dumpcap
 	BufferedPackets        uint64           // Maximum number of packets buffered within dumpcap
+	CaptureComments        []string         // Comments written to the section header of the capture file; requires PCAP-ng
 	CaptureFilter          string           // Default packet filter for all devices
+	Compression            uint8            // Compress ringbuffer files once they are written (See UseGzipCompression).
 	DeviceArgs             []DeviceArgument // Device specific arguments. Notice that dumpcap will always write PCAP-ng if more than one device is used.
 	DisablePromiscuousMode bool             // Don't capture in promiscuous mode
 	EnableGroupAccess      bool             // Enable group read access on the output file(s)
@@ -130,14 +265,21 @@ type Arguments struct {
 	FileName               string           // Name of the file to save
 	KernelBufferSize       uint64           // Default size of kernel buffer in MiB
 	LinkLayerType          string           // Default link layer name to capture traffic on
+	RingbufferNameTimeNum  bool             // Name ringbuffer files "prefix_YYYYmmddHHMMSS_NNNNN.ext" instead of "prefix_NNNNN_YYYYmmddHHMMSS.ext"
+	RingbufferPrintName    string           // Print the name of each ringbuffer file to this file once it is written; may be "stdout" or "stderr"
 	SnapshotLength         uint64           // Default packet snapshot length
 	StopOnDuration         uint64           // Stop after this number of seconds
 	StopOnFiles            uint64           // Stop after this number of files
 	StopOnFilesize         uint64           // Stop after this number of KB written
+	StopOnInterval         time.Duration    // Stop when the time is an exact multiple of this interval. Given in whole seconds.
 	StopOnPacketCount      uint64           // Stop capturing after this number of packets
+	StopOnPackets          uint64           // Stop after this number of packets were written, given as an autostop condition instead of StopOnPacketCount
 	SwitchOnDuration       uint64           // Switch to next file after this number of seconds
 	SwitchOnFiles          uint64           // Replace after this number of files
 	SwitchOnFilesize       uint64           // Switch to next file after this number of KB written
+	SwitchOnInterval       time.Duration    // Switch to next file when the time is an exact multiple of this interval. Given in whole seconds.
+	SwitchOnPackets        uint64           // Switch to next file after this number of packets
+	TempDir                string           // Directory to write temporary files to if no FileName is given
 	UseThreads             bool             // Tell dumpcap to use a separate thread per interface
 	WiFiChannel            string           // Set default channel on Wifi device. Given as "<freq>,[<type>]"
 	command                string           // The command to execute
@@ -162,6 +304,9 @@ func (a Arguments) buildArgs() []string {
 			r = append(r, a, fmt.Sprintf(prefix+":%d", v))
 		}
 	}
+	secondsArg := func(v time.Duration, a, prefix string) {
+		prefixedIntArg(uint64(v/time.Second), a, prefix)
+	}
 	boolArg := func(v bool, a string) {
 		if v {
 			r = append(r, a)
@@ -181,6 +326,9 @@ func (a Arguments) buildArgs() []string {
 	intArg(a.BufferedBytes, bufferedBytesArg)
 	intArg(a.BufferedPackets, bufferedPacketsArg)
 	stringArg(a.CaptureFilter, captureFilterArg)
+	if a.Compression == UseGzipCompression {
+		r = append(r, compressTypeArg, gzipCompression)
+	}
 	boolArg(a.DisablePromiscuousMode, disablePromiscuousArg)
 	boolArg(a.EnableGroupAccess, enableGroupAccessArg)
 	boolArg(a.EnableMonitorMode, enableMonitorModeArg)
@@ -196,12 +344,26 @@ func (a Arguments) buildArgs() []string {
 	prefixedIntArg(a.StopOnDuration, autoStopConditionArg, durationArg)
 	prefixedIntArg(a.StopOnFiles, autoStopConditionArg, filesArg)
 	prefixedIntArg(a.StopOnFilesize, autoStopConditionArg, filesizeArg)
+	secondsArg(a.StopOnInterval, autoStopConditionArg, intervalArg)
 	intArg(a.StopOnPacketCount, packetCountArg)
+	prefixedIntArg(a.StopOnPackets, autoStopConditionArg, packetsArg)
 	prefixedIntArg(a.SwitchOnDuration, ringbufferArg, durationArg)
 	prefixedIntArg(a.SwitchOnFiles, ringbufferArg, filesArg)
 	prefixedIntArg(a.SwitchOnFilesize, ringbufferArg, filesizeArg)
+	secondsArg(a.SwitchOnInterval, ringbufferArg, intervalArg)
+	prefixedIntArg(a.SwitchOnPackets, ringbufferArg, packetsArg)
+	if a.RingbufferNameTimeNum {
+		r = append(r, ringbufferArg, nameTimeNumArg+":2")
+	}
+	if a.RingbufferPrintName != "" {
+		r = append(r, ringbufferArg, printNameArg+":"+a.RingbufferPrintName)
+	}
+	stringArg(a.TempDir, tempDirArg)
 	boolArg(a.UseThreads, useThreadsArg)
 	stringArg(a.WiFiChannel, wifiChannelArg)
+	for _, c := range a.CaptureComments {
+		r = append(r, captureCommentArg, c)
+	}
 
 	// Device specific arguments come second
 	for _, da := range a.DeviceArgs {
@@ -210,11 +372,25 @@ func (a Arguments) buildArgs() []string {
 		}
 		// TODO name can be nil on windows, use number from Device instead ?!
 		stringArg(da.Name, interfaceArg)
+		stringArg(da.CaptureFilter, captureFilterArg)
 		boolArg(da.DisablePromiscuousMode, disablePromiscuousArg)
 		boolArg(da.EnableMonitorMode, enableMonitorModeArg)
+		stringArg(da.IfDescription, ifDescriptionArg)
+		stringArg(da.IfName, ifNameArg)
 		intArg(da.KernelBufferSize, kernelBufferSizeArg)
 		stringArg(da.LinkLayerType, linkLayerTypeArg)
+		if da.NanosecondTimestamps {
+			r = append(r, timestampPrecisionArg, nanoPrecision)
+		}
+		boolArg(da.RemoteCaptureOwnTraffic, remoteCaptureOwnTrafficArg)
+		boolArg(da.RemoteUDP, remoteUDPArg)
+		if da.RemoteUsername != "" {
+			r = append(r, remoteAuthArg, da.RemoteUsername+":"+da.RemotePassword)
+		}
+		prefixedIntArg(uint64(da.SampleInterval/time.Millisecond), samplingArg, timerArg)
+		prefixedIntArg(da.SampleOneOf, samplingArg, countArg)
 		intArg(da.SnapshotLength, snaplenArg)
+		stringArg(da.TimestampType, timestampTypeArg)
 		stringArg(da.WiFiChannel, wifiChannelArg)
 	}
 
@@ -228,7 +404,7 @@ func (a Arguments) String() string {
 // Version returns the first line "dumpcap -v" gives.
 // The line usually takes the form "Dumpcap X.Y.Z (Git ...)".
 func (d *Dumpcap) Version() (string, error) {
-	buf, err := d.newCommand(d.Executable, versionCmd).Output()
+	buf, err := d.command(versionCmd).Output()
 	if err != nil {
 		return "", err
 	}
@@ -248,36 +424,88 @@ func (d *Dumpcap) VersionString() string {
 // Capture represents a dumpcap subprocess capturing live traffic from a
 // network device.
 type Capture struct {
-	child      commander
-	stderr     io.ReadCloser
-	Messages   chan PipeMessage
-	exitStatus chan error
-	quit       chan int
+	child       Commander
+	stderr      io.ReadCloser
+	stdout      io.ReadCloser
+	Messages    chan PipeMessage
+	exitStatus  chan error
+	quit        chan int
+	quitOnce    *sync.Once
+	done        chan int
+	ctx         context.Context
+	stopContext func() bool
+	fileSuffix  string // added to the names reported by FileMsg once dumpcap is done with them
+	args        Arguments
 }
 
 // NewCapture calls dumpcap to capture network data according to the given
 // Arguments struct. Dumpcap is started immediatly, events are reported on
-// Capture.Messages.
+// Capture.Messages. If Arguments.FileName is StdoutFileName, captured packets
+// are not written to disk but can be read from Capture.Packets().
+// The Arguments are checked using Arguments.Validate() first. Only if
+// Features() was called successfully before, Arguments which dumpcap does not
+// support are refused with an *UnsupportedError as well; dumpcap is not
+// queried for it's features by NewCapture itself.
 func (d *Dumpcap) NewCapture(args Arguments) (*Capture, error) {
+	return d.NewCaptureContext(context.Background(), args)
+}
+
+// NewCaptureContext is like NewCapture but ties the dumpcap-process to the
+// given context. If the context is done before dumpcap exits on it's own,
+// dumpcap is killed, the pipe is closed and Capture.Messages is closed; Wait()
+// reports ctx.Err() in that case.
+func (d *Dumpcap) NewCaptureContext(ctx context.Context, args Arguments) (*Capture, error) {
 	var err error
 	args.command = captureCmd
 	args.childMode = true
 
+	if err = args.Validate(); err != nil {
+		return nil, err
+	}
+	if f := d.features.get(); f != nil {
+		if err = f.Check(args); err != nil {
+			return nil, err
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	c := Capture{}
-	c.child = d.newCommand(d.Executable, args.buildArgs()...)
+	c.child = d.command(args.buildArgs()...)
 	c.stderr, err = c.child.StderrPipe()
 	if err != nil {
 		return nil, err
 	}
+	if args.FileName == StdoutFileName {
+		c.stdout, err = c.child.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+	}
 	c.Messages = make(chan PipeMessage)
 	c.exitStatus = make(chan error, 1)
 	c.quit = make(chan int)
+	c.quitOnce = &sync.Once{}
+	c.done = make(chan int)
+	c.ctx = ctx
+	c.args = args
+	c.args.DeviceArgs = append([]DeviceArgument(nil), args.DeviceArgs...)
+	if args.Compression == UseGzipCompression {
+		c.fileSuffix = gzipSuffix
+	}
 
 	if err = c.child.Start(); err != nil {
 		return nil, err
 	}
+	c.stopContext = afterFunc(ctx, func() {
+		_ = c.Kill()
+		c.Close()
+		c.closeQuit()
+	})
 
 	go func() {
+		defer close(c.done)
 		defer close(c.Messages)
 		defer close(c.exitStatus)
 
@@ -292,6 +520,12 @@ func (d *Dumpcap) NewCapture(args Arguments) (*Capture, error) {
 				}
 				return
 			}
+			switch msg.Type {
+			case FileMsg:
+				msg.FinalFileName = msg.Text + c.fileSuffix
+			case BadFilterMsg:
+				c.args.resolveBadFilter(msg)
+			}
 			select {
 			case c.Messages <- *msg:
 			case <-c.quit:
@@ -303,26 +537,62 @@ func (d *Dumpcap) NewCapture(args Arguments) (*Capture, error) {
 	return &c, nil
 }
 
+// Packets returns the stream of captured packets as written by dumpcap in
+// PCAP or PCAP-ng format if the capture was started with Arguments.FileName
+// set to StdoutFileName; returns nil otherwise. Callers should read from the
+// stream as quickly as possible in order to avoid blocking dumpcap and must
+// read it until EOF before calling Wait().
+func (c Capture) Packets() io.Reader {
+	if c.stdout == nil {
+		return nil
+	}
+	return c.stdout
+}
+
+// closeQuit causes the goroutine reading from dumpcap to stop delivering
+// messages. It is safe to call closeQuit more than once.
+func (c Capture) closeQuit() {
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
 // Kill the dumpcap-process.
 func (c Capture) Kill() error {
-	return c.child.kill()
+	return c.child.Signal(os.Kill)
+}
+
+// Stop asks dumpcap to stop capturing by sending it an interrupt-signal. This
+// allows dumpcap to finish writing the current file and to report the final
+// number of packets written. Dumpcap is killed if it has not exited after the
+// given timeout. Stop returns the result of Wait(); callers must keep
+// receiving from Capture.Messages while Stop is in progress.
+func (c Capture) Stop(timeout time.Duration) error {
+	return stopChild(c.child, c.done, timeout, c.Wait)
 }
 
 // Wait until dumpcap has stopped capturing network traffic and exited on
 // it's own. Returns nil if and only if neither dumpcap nor the goroutine
-// parsing it's output reported an error.
+// parsing it's output reported an error. If dumpcap was killed because the
+// context given to NewCaptureContext was done, the context's error is
+// returned.
 func (c Capture) Wait() error {
 	err := c.child.Wait()
+	if !c.stopContext() && c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
-	close(c.quit)
+	c.closeQuit()
 	return <-c.exitStatus
 }
 
-// Close the pipe receiving messages from dumpcap and causes it to quit.
+// Close the pipes receiving messages and packets from dumpcap and causes it
+// to quit.
 func (c Capture) Close() {
 	_ = c.stderr.Close()
+	if c.stdout != nil {
+		_ = c.stdout.Close()
+	}
 }
 
 // DeviceStatistics represents one line of statistics as reported by dumpcap.
@@ -338,25 +608,35 @@ func (ds DeviceStatistics) String() string {
 
 // Statistics reads the number of packets seen by dumpcap about once per second.
 type Statistics struct {
-	child      commander
-	stdout     io.ReadCloser
-	Stats      chan DeviceStatistics
-	exitStatus chan error
-	quit       chan int
+	child       Commander
+	stdout      io.ReadCloser
+	Stats       chan DeviceStatistics
+	exitStatus  chan error
+	quit        chan int
+	quitOnce    *sync.Once
+	done        chan int
+	ctx         context.Context
+	stopContext func() bool
 }
 
-func parseStatisticsLine(line string) (devname string, packetcount, dropcount uint64, err error) {
+// parseStatisticsLine decodes a line of "dumpcap -S -M"'s output found at the
+// given offset.
+func parseStatisticsLine(line string, offset int64) (devname string, packetcount, dropcount uint64, err error) {
+	illegal := &ProtocolError{Offset: offset, Raw: []byte(line)}
 	cols := strings.SplitN(line, "\t", 3)
 	if len(cols) != 3 {
-		return "", 0, 0, errors.New("illegal output from dumpcap")
+		return "", 0, 0, illegal
 	}
 	devname = cols[0]
 	packetcount, err = strconv.ParseUint(cols[1], 10, 64)
 	if err != nil {
-		return "", 0, 0, err
+		return "", 0, 0, illegal
 	}
 	dropcount, err = strconv.ParseUint(cols[2], 10, 64)
-	return devname, packetcount, dropcount, err
+	if err != nil {
+		return "", 0, 0, illegal
+	}
+	return devname, packetcount, dropcount, nil
 }
 
 // NewStatistics calls dumpcap to periodically report the number of packets
@@ -364,10 +644,21 @@ func parseStatisticsLine(line string) (devname string, packetcount, dropcount ui
 // from the returned Statistis.Stats-channel as soon as possible in order to
 // avoid blocking dumpcap trying to write new data.
 func (d *Dumpcap) NewStatistics() (*Statistics, error) {
+	return d.NewStatisticsContext(context.Background())
+}
+
+// NewStatisticsContext is like NewStatistics but ties the dumpcap-process to
+// the given context. If the context is done, dumpcap is killed, the pipe is
+// closed and Statistics.Stats is closed; Wait() reports ctx.Err() in that
+// case.
+func (d *Dumpcap) NewStatisticsContext(ctx context.Context) (*Statistics, error) {
 	var err error
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	stats := Statistics{}
-	stats.child = d.newCommand(
-		d.Executable,
+	stats.child = d.command(
 		Arguments{command: statsCmd, childMode: true}.buildArgs()...)
 	stats.stdout, err = stats.child.StdoutPipe()
 	if err != nil {
@@ -376,17 +667,28 @@ func (d *Dumpcap) NewStatistics() (*Statistics, error) {
 	stats.Stats = make(chan DeviceStatistics)
 	stats.exitStatus = make(chan error, 1)
 	stats.quit = make(chan int)
+	stats.quitOnce = &sync.Once{}
+	stats.done = make(chan int)
+	stats.ctx = ctx
 
 	if err = stats.child.Start(); err != nil {
 		return nil, err
 	}
+	stats.stopContext = afterFunc(ctx, func() {
+		_ = stats.Kill()
+		stats.Close()
+		stats.closeQuit()
+	})
 
 	go func() {
+		defer close(stats.done)
 		defer close(stats.Stats)
 		defer close(stats.exitStatus)
 		scanner := bufio.NewScanner(stats.stdout)
+		var offset int64
 		for scanner.Scan() {
-			devname, packetcount, dropcount, err := parseStatisticsLine(scanner.Text())
+			devname, packetcount, dropcount, err := parseStatisticsLine(scanner.Text(), offset)
+			offset += int64(len(scanner.Bytes())) + 1
 			if err != nil {
 				stats.exitStatus <- err
 				return
@@ -413,20 +715,40 @@ func (d *Dumpcap) NewStatistics() (*Statistics, error) {
 	return &stats, nil
 }
 
+// closeQuit causes the goroutine reading from dumpcap to stop delivering
+// statistics. It is safe to call closeQuit more than once.
+func (s Statistics) closeQuit() {
+	s.quitOnce.Do(func() { close(s.quit) })
+}
+
 // Kill the dumpcap-process.
 func (s Statistics) Kill() error {
-	return s.child.kill()
+	return s.child.Signal(os.Kill)
+}
+
+// Stop asks dumpcap to stop reporting statistics by sending it an
+// interrupt-signal, upon which dumpcap exits with process status 0. Dumpcap is
+// killed if it has not exited after the given timeout. Stop returns the result
+// of Wait(); callers must keep receiving from Statistics.Stats while Stop is
+// in progress.
+func (s Statistics) Stop(timeout time.Duration) error {
+	return stopChild(s.child, s.done, timeout, s.Wait)
 }
 
 // Wait until dumpcap has stopped reporting device statistics and exited on
 // it's own. Returns nil if and only if neither dumpcap nor the goroutine
-// parsing it's output reported an error.
+// parsing it's output reported an error. If dumpcap was killed because the
+// context given to NewStatisticsContext was done, the context's error is
+// returned.
 func (s Statistics) Wait() error {
 	err := s.child.Wait()
+	if !s.stopContext() && s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
-	close(s.quit)
+	s.closeQuit()
 	return <-s.exitStatus
 }
 
@@ -436,16 +758,17 @@ func (s Statistics) Close() {
 }
 
 // parseDeviceLine creates a Device struct from the []string produces by
-// deviceListRE
-func parseDevicesLine(fields []string) (dev *Device, err error) {
+// deviceListRE, which matched at the given offset
+func parseDevicesLine(fields []string, offset int64) (dev *Device, err error) {
 	dev = &Device{}
 	if len(fields) != 8 {
-		return nil, errors.New("illegal output from dumpcap")
+		return nil, &ProtocolError{Offset: offset, Raw: []byte(strings.Join(fields, "\t"))}
 	}
+	illegal := &ProtocolError{Offset: offset, Raw: []byte(fields[0])}
 
 	i, err := strconv.ParseUint(fields[1], 10, 0)
 	if err != nil {
-		return nil, err
+		return nil, illegal
 	}
 	dev.Number = uint(i)
 
@@ -455,7 +778,7 @@ func parseDevicesLine(fields []string) (dev *Device, err error) {
 
 	i, err = strconv.ParseUint(fields[5], 10, 8)
 	if err != nil {
-		return nil, err
+		return nil, illegal
 	}
 	dev.DevType = DeviceType(i)
 
@@ -474,19 +797,73 @@ func parseDevicesLine(fields []string) (dev *Device, err error) {
 // device into monitor-mode). If getCapabilities is false, the fields CanRFMon
 // and LLTs on all returned Device structs will be empty.
 func (d *Dumpcap) Devices(getCapabilities bool) ([]Device, error) {
-	buf, err := d.newCommand(d.Executable, machineReadableArg, listDevicesCmd).Output()
+	return d.DevicesContext(context.Background(), getCapabilities)
+}
+
+// DevicesContext is like Devices but kills dumpcap and returns ctx.Err() if
+// the given context is done before all devices have been listed.
+func (d *Dumpcap) DevicesContext(ctx context.Context, getCapabilities bool) ([]Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	child := d.command(machineReadableArg, listDevicesCmd)
+	stdout, err := child.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := child.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = child.Start(); err != nil {
+		return nil, err
+	}
+	stop := afterFunc(ctx, func() {
+		_ = child.Signal(os.Kill)
+		_ = stdout.Close()
+	})
+	// Dumpcap explains why it failed on it's standard error
+	var errBuf bytes.Buffer
+	stderrDone := make(chan int)
+	go func() {
+		_, _ = io.Copy(&errBuf, stderr)
+		close(stderrDone)
+	}()
+	buf, err := io.ReadAll(stdout)
+	if err != nil {
+		_ = child.Signal(os.Kill)
+	}
+	<-stderrDone
+	if waitErr := child.Wait(); err == nil {
+		err = waitErr
+	}
+	if !stop() && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	var ee *ExitError
+	if errors.As(err, &ee) && ee.Stderr == "" {
+		ee.Stderr = errBuf.String()
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	var devices []Device
-	for _, fields := range deviceListRE.FindAllStringSubmatch(string(buf), -1) {
-		dev, err := parseDevicesLine(fields)
+	output := string(buf)
+	for _, idx := range deviceListRE.FindAllStringSubmatchIndex(output, -1) {
+		fields := make([]string, len(idx)/2)
+		for i := range fields {
+			if idx[2*i] >= 0 {
+				fields[i] = output[idx[2*i]:idx[2*i+1]]
+			}
+		}
+		dev, err := parseDevicesLine(fields, int64(idx[0]))
 		if err != nil {
 			return nil, err
 		}
 		if getCapabilities {
-			if err = d.Capabilities(dev, false); err != nil {
+			if err = d.CapabilitiesContext(ctx, dev, false); err != nil {
 				return nil, err
 			}
 		}
@@ -504,16 +881,19 @@ func parseCapabilities(pipe io.Reader) (canRFMon bool, llts []LinkLayerType, err
 		return canRFMon, nil, scanner.Err()
 	}
 	canRFMon = scanner.Text() == "1"
+	offset := int64(len(scanner.Bytes())) + 1
 
 	for scanner.Scan() {
+		illegal := &ProtocolError{Offset: offset, Raw: append([]byte(nil), scanner.Bytes()...)}
+		offset += int64(len(scanner.Bytes())) + 1
 		cols := strings.SplitN(scanner.Text(), "\t", 3)
 		if len(cols) != 3 {
-			return canRFMon, nil, errors.New("illegal output from dumcap")
+			return canRFMon, nil, illegal
 		}
 		llt := LinkLayerType{}
 		i, err := strconv.ParseUint(cols[0], 10, 0)
 		if err != nil {
-			return canRFMon, nil, err
+			return canRFMon, nil, illegal
 		}
 		llt.DLT = uint(i)
 		llt.Name = cols[1]
@@ -524,17 +904,19 @@ func parseCapabilities(pipe io.Reader) (canRFMon bool, llts []LinkLayerType, err
 
 }
 
-// Capabilities makes a call to dumpcap to query the given device for supported
-// link-layer types and support for capturing in monitor-mode. The results are
-// written to the given Device struct.
-// Dumpcap will try to put the device into monitor-mode if monitorMode is true;
-// this may cause the device to lose all currently active connections.
-func (d *Dumpcap) Capabilities(dev *Device, monitorMode bool) error {
-	child := d.newCommand(d.Executable,
-		Arguments{command: listLayersCmd, childMode: true,
-			DeviceArgs: []DeviceArgument{{Name: dev.String(),
-				EnableMonitorMode: monitorMode}}}.buildArgs()...)
+// runChild starts dumpcap in child-mode using the given arguments and waits
+// for it to report success. The output dumpcap writes to it's standard output
+// is collected meanwhile, as dumpcap may write it before reporting success,
+// and passed to parse; dumpcap must exit successfully as well. Dumpcap is
+// killed and ctx.Err() is returned if the context is done before parse
+// returns.
+func (d *Dumpcap) runChild(ctx context.Context, args Arguments, parse func(io.Reader) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
+	args.childMode = true
+	child := d.command(args.buildArgs()...)
 	stdout, err := child.StdoutPipe()
 	if err != nil {
 		return err
@@ -546,20 +928,109 @@ func (d *Dumpcap) Capabilities(dev *Device, monitorMode bool) error {
 	if err = child.Start(); err != nil {
 		return err
 	}
-
-	if err = waitForSuccessMsg(stderr); err != nil {
-		return err
+	stop := afterFunc(ctx, func() {
+		_ = child.Signal(os.Kill)
+		_ = stdout.Close()
+		_ = stderr.Close()
+	})
+
+	// Reading stdout only after the success message could leave dumpcap
+	// blocked writing to a full pipe
+	var output []byte
+	var readErr error
+	outputDone := make(chan int)
+	go func() {
+		output, readErr = io.ReadAll(stdout)
+		close(outputDone)
+	}()
+	err = waitForSuccessMsg(stderr, args)
+	if err != nil {
+		// Dumpcap might keep running after failing, and so would reading
+		// it's output
+		_ = child.Signal(os.Kill)
+	}
+	<-outputDone
+	if err == nil {
+		err = readErr
+	}
+	if err == nil {
+		if err = parse(bytes.NewReader(output)); err != nil {
+			_ = child.Signal(os.Kill)
+		}
+	}
+	if waitErr := child.Wait(); err == nil {
+		err = waitErr
+	}
+	if !stop() && ctx.Err() != nil {
+		return ctx.Err()
 	}
+	return err
+}
 
-	canRFMon, llts, err := parseCapabilities(stdout)
-	if err != nil {
-		return err
+// Capabilities makes a call to dumpcap to query the given device for supported
+// link-layer types and support for capturing in monitor-mode. The results are
+// written to the given Device struct.
+// Dumpcap will try to put the device into monitor-mode if monitorMode is true;
+// this may cause the device to lose all currently active connections.
+func (d *Dumpcap) Capabilities(dev *Device, monitorMode bool) error {
+	return d.CapabilitiesContext(context.Background(), dev, monitorMode)
+}
+
+// CapabilitiesContext is like Capabilities but kills dumpcap and returns
+// ctx.Err() if the given context is done before the device was queried.
+func (d *Dumpcap) CapabilitiesContext(ctx context.Context, dev *Device, monitorMode bool) error {
+	args := Arguments{command: listLayersCmd,
+		DeviceArgs: []DeviceArgument{{Name: dev.String(),
+			EnableMonitorMode: monitorMode}}}
+
+	return d.runChild(ctx, args, func(stdout io.Reader) error {
+		canRFMon, llts, err := parseCapabilities(stdout)
+		if err != nil {
+			return err
+		}
+		dev.CanRFMon = canRFMon
+		dev.LLTs = llts
+		return nil
+	})
+}
+
+// parseTimestampTypes reads "dumpcap --list-time-stamp-types -Z"'s output
+// from a Reader and constructs TimestampType structs from it.
+func parseTimestampTypes(pipe io.Reader) (tts []TimestampType, err error) {
+	scanner := bufio.NewScanner(pipe)
+	var offset int64
+	for scanner.Scan() {
+		cols := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(cols) != 2 {
+			return nil, &ProtocolError{Offset: offset, Raw: []byte(scanner.Text())}
+		}
+		offset += int64(len(scanner.Bytes())) + 1
+		tts = append(tts, TimestampType{Name: cols[0], Description: cols[1]})
 	}
+	return tts, scanner.Err()
+}
+
+// TimestampTypes makes a call to dumpcap to query the given device for the
+// time stamp types it supports. The results are written to the given Device
+// struct.
+func (d *Dumpcap) TimestampTypes(dev *Device) error {
+	return d.TimestampTypesContext(context.Background(), dev)
+}
 
-	dev.CanRFMon = canRFMon
-	dev.LLTs = llts
+// TimestampTypesContext is like TimestampTypes but kills dumpcap and returns
+// ctx.Err() if the given context is done before the device was queried.
+func (d *Dumpcap) TimestampTypesContext(ctx context.Context, dev *Device) error {
+	args := Arguments{command: listTimestampTypesCmd,
+		DeviceArgs: []DeviceArgument{{Name: dev.String()}}}
 
-	return nil
+	return d.runChild(ctx, args, func(stdout io.Reader) error {
+		tts, err := parseTimestampTypes(stdout)
+		if err != nil {
+			return err
+		}
+		dev.TimestampTypes = tts
+		return nil
+	})
 }
 
 // Version is a Convenience-function to execute Version() on a new Dumpcap-struct
@@ -577,17 +1048,47 @@ func NewCapture(args Arguments) (*Capture, error) {
 	return NewDumpcap().NewCapture(args)
 }
 
+// NewCaptureContext is a convenience-function to execute NewCaptureContext() on a new Dumpcap-struct
+func NewCaptureContext(ctx context.Context, args Arguments) (*Capture, error) {
+	return NewDumpcap().NewCaptureContext(ctx, args)
+}
+
 // Capabilities is a convenience-function to execute Capabilities() on a new Dumpcap-struct
 func Capabilities(dev *Device, monitorMode bool) error {
 	return NewDumpcap().Capabilities(dev, monitorMode)
 }
 
+// CapabilitiesContext is a convenience-function to execute CapabilitiesContext() on a new Dumpcap-struct
+func CapabilitiesContext(ctx context.Context, dev *Device, monitorMode bool) error {
+	return NewDumpcap().CapabilitiesContext(ctx, dev, monitorMode)
+}
+
+// TimestampTypes is a convenience-function to execute TimestampTypes() on a new Dumpcap-struct
+func TimestampTypes(dev *Device) error {
+	return NewDumpcap().TimestampTypes(dev)
+}
+
+// TimestampTypesContext is a convenience-function to execute TimestampTypesContext() on a new Dumpcap-struct
+func TimestampTypesContext(ctx context.Context, dev *Device) error {
+	return NewDumpcap().TimestampTypesContext(ctx, dev)
+}
+
 // NewStatistics is a convenience-function to execute NewStatistics() on a new Dumpcap-struct
 func NewStatistics() (*Statistics, error) {
 	return NewDumpcap().NewStatistics()
 }
 
+// NewStatisticsContext is a convenience-function to execute NewStatisticsContext() on a new Dumpcap-struct
+func NewStatisticsContext(ctx context.Context) (*Statistics, error) {
+	return NewDumpcap().NewStatisticsContext(ctx)
+}
+
 // Devices is a convenience-function to execute Devices() on a new Dumpcap-struct
 func Devices(getCapabilities bool) ([]Device, error) {
 	return NewDumpcap().Devices(getCapabilities)
 }
+
+// DevicesContext is a convenience-function to execute DevicesContext() on a new Dumpcap-struct
+func DevicesContext(ctx context.Context, getCapabilities bool) ([]Device, error) {
+	return NewDumpcap().DevicesContext(ctx, getCapabilities)
+}
@@ -2,95 +2,182 @@ package dumpcap
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/lukaslueg/dumpcap/syncpipe"
 )
 
 const (
-	successText          string = "This is a huge success"
-	errText1                    = "Not so much"
-	errText2                    = "Something is wrong"
-	mockFailStartArg            = "--FAIL_START"
-	mockFailExitArg             = "--FAIL_EXIT"
-	mockFailFilterArg           = "--FAIL_FILTER"
-	mockFailSilenceArg          = "--FAIL_OUPUT"
-	mockIllegalOutputArg        = "--ILLEGAL_OUTPUT"
-	statsOutput                 = "devX\t123\t456\n"
-	interfacesOutput            = "1. em1\t\t\t0\t\tnetwork\n" +
+	successText            string = "This is a huge success"
+	errText1                      = "Not so much"
+	errText2                      = "Something is wrong"
+	mockFailStartArg              = "--FAIL_START"
+	mockFailExitArg               = "--FAIL_EXIT"
+	mockFailFilterArg             = "--FAIL_FILTER"
+	mockFailSilenceArg            = "--FAIL_OUPUT"
+	mockIllegalOutputArg          = "--ILLEGAL_OUTPUT"
+	mockBlockArg                  = "--BLOCK"
+	mockIgnoreInterruptArg        = "--IGNORE_INTERRUPT"
+	mockRealVersionArg            = "--REAL_VERSION"
+	mockRPCAPCredentials          = "mockuser:mockpass"
+	statsOutput                   = "devX\t123\t456\n"
+	interfacesOutput              = "1. em1\t\t\t0\t\tnetwork\n" +
 		"2. lo\t\tLoopback\t0\t127.0.0.1,::1\tloopback\n"
 	layersOutput = "1\n1\tEN10MB\tEthernet\n143\tDOCSIS\tDOCSIS\n"
 	gibberish    = "foobar\n"
+	tstampOutput = "host\tHost\nadapter_unsynced\tAdapter, not synced with system time\n"
 )
 
+var packetsOutput = string(pcapFile(123))
+
 var errFailStart = errors.New("some error while starting the subprocess")
 var errFailExit = errors.New("dumpcap returned nonzero exit status")
+var errKilled = errors.New("dumpcap was killed")
 
 func generateMsg(msgType uint8, msgText string) []byte {
-	msgText += "\x00"
-	msgLen := len(msgText)
 	var b bytes.Buffer
-	b.Write([]byte{byte(msgType), byte(msgLen >> 16), byte(msgLen >> 8), byte(msgLen)})
-	b.Write([]byte(msgText))
+	syncpipe.NewWriter(&b).WriteFrame(msgType, []byte(msgText+"\x00"))
 	return b.Bytes()
 }
 
 func generateErrorMsg(msgText1 string, msgText2 string) []byte {
-	msg := generateMsg(ErrMsg, msgText1)
-	msg = append(msg, generateMsg(ErrMsg, msgText2)...)
-	return generateMsg(ErrMsg, string(msg))
+	var b bytes.Buffer
+	syncpipe.NewWriter(&b).WriteMessage(&syncpipe.Message{Type: ErrMsg,
+		Primary: msgText1, Secondary: msgText2})
+	return b.Bytes()
 }
 
 // Testing the dumpcap tool without actually calling a subprocess.
 type mockCommand struct {
-	stdout      mockPipe
-	stderr      mockPipe
-	commandfunc func()
-	failStart   bool
-	failExit    bool
-	failOutput  string
-	quit        chan int
+	stdout          mockPipe
+	stderr          mockPipe
+	commandfunc     func()
+	failStart       bool
+	failExit        bool
+	failOutput      string
+	toStdout        bool
+	realVersion     bool
+	fileName        string
+	interfaces      int    // the number of interfaces given by "-i"
+	remote          bool   // capturing from an rpcap:// or TCP@ interface
+	remoteAuth      string // the credentials given by "-A"
+	block           bool
+	ignoreInterrupt bool
+	quit            chan int
+	killed          chan int
+	killOnce        sync.Once
+	interrupted     chan int
+	interruptOnce   sync.Once
 }
 
-func writePipe(p chan byte, buf []byte) {
+// writePipe writes buf to the given pipe unless the command gets killed.
+func (c *mockCommand) writePipe(p chan byte, buf []byte) {
 	for _, b := range buf {
-		p <- b
+		select {
+		case p <- b:
+		case <-c.killed:
+			return
+		}
 	}
 }
 
 func (c *mockCommand) mockedVersionCmd() {
-	writePipe(c.stdout.pipe, []byte(successText))
+	if c.realVersion {
+		c.writePipe(c.stdout.pipe, []byte(versionOutput36))
+	} else {
+		c.writePipe(c.stdout.pipe, []byte(successText))
+	}
+}
+
+func (c *mockCommand) mockedHelpCmd() {
+	c.writePipe(c.stdout.pipe, []byte(helpOutput))
 }
 
 func (c *mockCommand) mockedDevicesCmd() {
-	writePipe(c.stdout.pipe, []byte(interfacesOutput))
+	c.writePipe(c.stdout.pipe, []byte(interfacesOutput))
 }
 
 func (c *mockCommand) mockedCapabilitiesCmd() {
-	writePipe(c.stderr.pipe, generateMsg(SuccessMsg, successText))
-	writePipe(c.stdout.pipe, []byte(layersOutput))
+	c.writePipe(c.stderr.pipe, generateMsg(SuccessMsg, successText))
+	c.writePipe(c.stdout.pipe, []byte(layersOutput))
+}
+
+func (c *mockCommand) mockedTimestampTypesCmd() {
+	c.writePipe(c.stderr.pipe, generateMsg(SuccessMsg, successText))
+	if c.failOutput == mockIllegalOutputArg {
+		c.writePipe(c.stdout.pipe, []byte(gibberish))
+	} else {
+		c.writePipe(c.stdout.pipe, []byte(tstampOutput))
+	}
+}
+
+func (c *mockCommand) mockedCompileFilterCmd() {
+	if c.failOutput == mockFailFilterArg {
+		c.writePipe(c.stderr.pipe, generateMsg(BadFilterMsg, "0:"+errText1))
+		return
+	}
+	// Unlike other commands, dumpcap prints the code before reporting success
+	if c.failOutput == mockIllegalOutputArg {
+		c.writePipe(c.stdout.pipe, []byte(gibberish))
+	} else {
+		c.writePipe(c.stdout.pipe, []byte(bpfOutput))
+	}
+	c.writePipe(c.stderr.pipe, generateMsg(SuccessMsg, successText))
 }
 
 func (c *mockCommand) mockedStatsCmd() {
 	if c.failOutput == mockIllegalOutputArg {
-		writePipe(c.stdout.pipe, []byte(gibberish))
+		c.writePipe(c.stdout.pipe, []byte(gibberish))
 	} else {
 		for {
-			writePipe(c.stdout.pipe, []byte(statsOutput))
+			select {
+			case <-c.killed:
+				return
+			case <-c.interrupted:
+				return
+			default:
+				c.writePipe(c.stdout.pipe, []byte(statsOutput))
+			}
 		}
 	}
 }
 
 func (c *mockCommand) mockedCaptureCmd() {
-	if c.failOutput == mockFailFilterArg {
-		writePipe(c.stderr.pipe, generateMsg(BadFilterMsg, errText1))
+	if c.remote && c.remoteAuth != mockRPCAPCredentials {
+		// Stand-in for an rpcapd refusing the connection
+		c.writePipe(c.stderr.pipe, generateErrorMsg("Can't get list of interfaces",
+			"Authentication failed: user name or password incorrect"))
+	} else if c.failOutput == mockFailFilterArg {
+		// Blame the last interface, like dumpcap does using it's index
+		index := 0
+		if c.interfaces > 0 {
+			index = c.interfaces - 1
+		}
+		c.writePipe(c.stderr.pipe, generateMsg(BadFilterMsg, fmt.Sprintf("%d:%s", index, errText1)))
 	} else if c.failOutput == mockIllegalOutputArg {
-		writePipe(c.stderr.pipe, []byte(gibberish))
+		c.writePipe(c.stderr.pipe, []byte(gibberish))
 	} else {
-		writePipe(c.stderr.pipe, generateMsg(FileMsg, "foobar"))
-		writePipe(c.stderr.pipe, generateMsg(PacketCountMsg, "123"))
-		writePipe(c.stderr.pipe, generateMsg(DropCountMsg, "456"))
+		fileName := "foobar"
+		if c.fileName != "" && !c.toStdout {
+			fileName = c.fileName
+		}
+		c.writePipe(c.stderr.pipe, generateMsg(FileMsg, fileName))
+		if c.toStdout {
+			// Like dumpcap, report packets only after writing them
+			c.writePipe(c.stdout.pipe, []byte(packetsOutput))
+		}
+		c.writePipe(c.stderr.pipe, generateMsg(PacketCountMsg, "123"))
+		c.writePipe(c.stderr.pipe, generateMsg(DropCountMsg, "456"))
 	}
 }
 
@@ -103,7 +190,17 @@ func (c *mockCommand) Start() error {
 	}
 
 	go func() {
-		c.commandfunc()
+		if c.block {
+			// Run the command only once interrupted, like dumpcap reporting
+			// it's final messages
+			select {
+			case <-c.killed:
+			case <-c.interrupted:
+				c.commandfunc()
+			}
+		} else {
+			c.commandfunc()
+		}
 		close(c.stdout.pipe)
 		close(c.stderr.pipe)
 	}()
@@ -128,6 +225,13 @@ func (c *mockCommand) StderrPipe() (io.ReadCloser, error) {
 }
 
 func (c *mockCommand) Wait() error {
+	if c.block {
+		select {
+		case <-c.killed:
+			return errKilled
+		case <-c.interrupted:
+		}
+	}
 	if c.failExit {
 		return errFailExit
 	}
@@ -146,7 +250,12 @@ func (c *mockCommand) Output() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (c *mockCommand) kill() error {
+func (c *mockCommand) Signal(sig os.Signal) error {
+	if sig == os.Kill {
+		c.killOnce.Do(func() { close(c.killed) })
+	} else if !c.ignoreInterrupt {
+		c.interruptOnce.Do(func() { close(c.interrupted) })
+	}
 	return nil
 }
 
@@ -181,29 +290,54 @@ func (p mockPipe) Close() error {
 	return p.closeError
 }
 
-func newMockCommand(name string, arg ...string) commander {
+func newMockCommand(name string, arg ...string) Commander {
 	var c mockCommand
 	c.commandfunc = c.mockedCaptureCmd
 	c.quit = make(chan int)
+	c.killed = make(chan int)
+	c.interrupted = make(chan int)
 	c.stdout = newMockPipe()
 	c.stderr = newMockPipe()
 
 	// Setup the test by interpreting the arguments given by the test functions
 	// as if they were calling dumpcap itself
-	for _, a := range arg {
+	for i, a := range arg {
+		if i > 0 && arg[i-1] == fileArg {
+			c.fileName = a
+			c.toStdout = a == StdoutFileName
+		}
+		if i > 0 && arg[i-1] == interfaceArg {
+			c.interfaces++
+			c.remote = c.remote || isRemote(a)
+		}
+		if i > 0 && arg[i-1] == remoteAuthArg {
+			c.remoteAuth = a
+		}
 		switch a {
 		case versionCmd:
 			c.commandfunc = c.mockedVersionCmd
+		case helpCmd:
+			c.commandfunc = c.mockedHelpCmd
+		case mockRealVersionArg:
+			c.realVersion = true
 		case statsCmd:
 			c.commandfunc = c.mockedStatsCmd
 		case listDevicesCmd:
 			c.commandfunc = c.mockedDevicesCmd
 		case listLayersCmd:
 			c.commandfunc = c.mockedCapabilitiesCmd
+		case listTimestampTypesCmd:
+			c.commandfunc = c.mockedTimestampTypesCmd
+		case compileFilterCmd:
+			c.commandfunc = c.mockedCompileFilterCmd
 		case mockFailStartArg:
 			c.failStart = true
 		case mockFailExitArg:
 			c.failExit = true
+		case mockBlockArg:
+			c.block = true
+		case mockIgnoreInterruptArg:
+			c.ignoreInterrupt = true
 		case mockIllegalOutputArg, mockFailSilenceArg, mockFailFilterArg:
 			c.failOutput = a
 		}
@@ -212,12 +346,11 @@ func newMockCommand(name string, arg ...string) commander {
 }
 
 func newMockcap(testArg ...string) Dumpcap {
-	d := Dumpcap{}
-	d.newCommand = func(name string, arg ...string) commander {
+	d := NewDumpcapWithRunner(func(name string, arg ...string) Commander {
 		finalArg := append(arg, testArg...)
 		return newMockCommand(name, finalArg...)
-	}
-	return d
+	})
+	return *d
 }
 
 func TestVersion(t *testing.T) {
@@ -227,6 +360,62 @@ func TestVersion(t *testing.T) {
 	}
 }
 
+func TestNewDumpcapWithRunner(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Like running dumpcap using sudo
+	d := NewDumpcapWithRunner(func(name string, arg ...string) Commander {
+		return NewOSCommand(sh, append([]string{"-c", `echo "Wrapped $0 $@"`, name}, arg...)...)
+	})
+	if v, err := d.Version(); v != "Wrapped dumpcap -v" || err != nil {
+		t.Error(v, err)
+	}
+
+	c := NewOSCommand(sh, "-c", "sleep 10")
+	if err = c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Signal(os.Kill); err != nil {
+		t.Error(err)
+	}
+	var ee *ExitError
+	if err = c.Wait(); !errors.As(err, &ee) || ee.Code != -1 {
+		t.Error(err)
+	}
+}
+
+func TestNetNamespace(t *testing.T) {
+	var calls [][]string
+	d := NewDumpcapWithRunner(func(name string, arg ...string) Commander {
+		calls = append(calls, append([]string{name}, arg...))
+		return newMockCommand(name, arg...)
+	})
+	d.NetNamespace = "blue"
+	if _, err := d.Devices(false); err != nil {
+		t.Fatal(err)
+	}
+	d.NetNamespace = "/var/run/docker/netns/1234"
+	d.Version()
+	// Our own user namespace is never joined
+	d.NetNamespace = strconv.Itoa(os.Getpid())
+	d.Version()
+	expected := []string{
+		"nsenter --net=/run/netns/blue -- dumpcap -M -D",
+		"nsenter --net=/var/run/docker/netns/1234 -- dumpcap -v",
+		"nsenter --net=/proc/" + d.NetNamespace + "/ns/net -- dumpcap -v",
+	}
+	if len(calls) != len(expected) {
+		t.Fatal(calls)
+	}
+	for i, call := range calls {
+		if strings.Join(call, " ") != expected[i] {
+			t.Error(call)
+		}
+	}
+}
+
 func TestVersionFailsToStart(t *testing.T) {
 	d := newMockcap(mockFailStartArg)
 	if v, err := d.Version(); v != "" || err != errFailStart {
@@ -266,7 +455,7 @@ func TestCaptureFails(t *testing.T) {
 	if ok {
 		t.Error("there should be no mesage, the channel closed")
 	}
-	if err = c.Wait(); err != errUnknownMessageType {
+	if err = c.Wait(); !errors.Is(err, syncpipe.ErrInvalidHeader) {
 		t.Error(err)
 	}
 }
@@ -298,6 +487,51 @@ func TestCapture(t *testing.T) {
 	}
 }
 
+func TestCapturePackets(t *testing.T) {
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: StdoutFileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(c.Packets())
+		if err != nil {
+			t.Error(err)
+		}
+		packets <- buf
+	}()
+	n := 0
+	for range c.Messages {
+		n++
+	}
+	if n != 3 {
+		t.Error(n)
+	}
+	if buf := <-packets; string(buf) != packetsOutput {
+		t.Error(buf)
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCaptureNoPackets(t *testing.T) {
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: "foobar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Packets() != nil {
+		t.Error("there should be no packet stream")
+	}
+	for range c.Messages {
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestCaptureBadFilter(t *testing.T) {
 	d := newMockcap(mockFailFilterArg)
 	var c *Capture
@@ -310,6 +544,110 @@ func TestCaptureBadFilter(t *testing.T) {
 	if msg.Type != BadFilterMsg || msg.Text != errText1 {
 		t.Error(msg.Type, msg.Text)
 	}
+	if msg.InterfaceIndex != 0 || msg.Device != nil {
+		t.Error(msg)
+	}
+}
+
+func TestCaptureBadFilterDevice(t *testing.T) {
+	d := newMockcap(mockFailFilterArg)
+	args := Arguments{CaptureFilter: "port 53",
+		DeviceArgs: []DeviceArgument{{Name: "em1", CaptureFilter: "port 80"}, {Name: "em2"}}}
+	c, err := d.NewCapture(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-c.Messages
+	if msg.Type != BadFilterMsg || msg.Text != errText1 || msg.InterfaceIndex != 1 ||
+		msg.Device == nil || msg.Device.Name != "em2" {
+		t.Fatal(msg)
+	}
+	var bfe *BadFilterError
+	if !errors.As(msg.Err(), &bfe) || bfe.Interface != "em2" || bfe.Filter != "port 53" ||
+		bfe.Message != errText1 {
+		t.Error(msg.Err())
+	}
+
+	// The message refers to a copy of the arguments
+	args.DeviceArgs[1].Name = "foobar"
+	if msg.Device.Name != "em2" {
+		t.Error(msg.Device)
+	}
+}
+
+func TestCaptureContext(t *testing.T) {
+	d := newMockcap(mockBlockArg)
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := d.NewCaptureContext(ctx, Arguments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for msg := range c.Messages {
+		t.Error("there should be no message", msg)
+	}
+	if err = c.Wait(); err != context.Canceled {
+		t.Error(err)
+	}
+}
+
+func TestCaptureContextDone(t *testing.T) {
+	d := newMockcap()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.NewCaptureContext(ctx, Arguments{}); err != context.Canceled {
+		t.Error(err)
+	}
+}
+
+func TestCaptureContextNotDone(t *testing.T) {
+	d := newMockcap()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := d.NewCaptureContext(ctx, Arguments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range c.Messages {
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCaptureStop(t *testing.T) {
+	d := newMockcap(mockBlockArg)
+	c, err := d.NewCapture(Arguments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make(chan []PipeMessage)
+	go func() {
+		var m []PipeMessage
+		for msg := range c.Messages {
+			m = append(m, msg)
+		}
+		msgs <- m
+	}()
+	if err = c.Stop(time.Second); err != nil {
+		t.Error(err)
+	}
+	// The final messages are delivered before dumpcap exits
+	if m := <-msgs; len(m) != 3 || m[1].Type != PacketCountMsg || m[1].PacketCount != 123 {
+		t.Error(m)
+	}
+}
+
+func TestCaptureStopKills(t *testing.T) {
+	d := newMockcap(mockBlockArg, mockIgnoreInterruptArg)
+	c, err := d.NewCapture(Arguments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Stop(10 * time.Millisecond); err != errKilled {
+		t.Error(err)
+	}
 }
 
 func TestStatisticsFailsStart(t *testing.T) {
@@ -364,7 +702,44 @@ func TestStatisticsIllegalOutput(t *testing.T) {
 	}
 
 	s.Close()
-	if err = s.Wait(); err == nil {
+	var pe *ProtocolError
+	if err = s.Wait(); !errors.As(err, &pe) || pe.Offset != 0 || string(pe.Raw) != "foobar" {
+		t.Error(err)
+	}
+}
+
+func TestStatisticsContext(t *testing.T) {
+	d := newMockcap()
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := d.NewStatisticsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-s.Stats; !ok {
+		t.Fatal("there should be statistics")
+	}
+	cancel()
+	for range s.Stats {
+	}
+	if err = s.Wait(); err != context.Canceled {
+		t.Error(err)
+	}
+}
+
+func TestStatisticsStop(t *testing.T) {
+	d := newMockcap()
+	s, err := d.NewStatistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-s.Stats; !ok {
+		t.Fatal("there should be statistics")
+	}
+	go func() {
+		for range s.Stats {
+		}
+	}()
+	if err = s.Stop(time.Second); err != nil {
 		t.Error(err)
 	}
 }
@@ -402,6 +777,30 @@ func TestDevices(t *testing.T) {
 	}
 }
 
+func TestDevicesContext(t *testing.T) {
+	d := newMockcap(mockBlockArg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if devices, err := d.DevicesContext(ctx, false); err != context.DeadlineExceeded {
+		t.Error(devices, err)
+	}
+}
+
+func TestDevicesExitError(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	d := NewDumpcapWithRunner(func(name string, arg ...string) Commander {
+		return NewOSCommand(sh, "-c", "echo 'You do not have permission' >&2; exit 2")
+	})
+	var ee *ExitError
+	if _, err = d.Devices(false); !errors.As(err, &ee) || ee.Code != 2 ||
+		ee.Stderr != "You do not have permission\n" {
+		t.Error(err)
+	}
+}
+
 func TestCapabilitiesFailsStart(t *testing.T) {
 	d := newMockcap(mockFailStartArg)
 	dev := Device{Name: "devX"}
@@ -434,6 +833,151 @@ func TestCapabilities(t *testing.T) {
 
 }
 
+func TestCapabilitiesContext(t *testing.T) {
+	d := newMockcap(mockBlockArg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	dev := Device{Name: "em1"}
+	if err := d.CapabilitiesContext(ctx, &dev, false); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	if dev.CanRFMon || len(dev.LLTs) != 0 {
+		t.Error(dev)
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	called := make(chan int)
+	stop := afterFunc(ctx, func() { close(called) })
+	cancel()
+	<-called
+	if stop() {
+		t.Error("f was already called")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stop = afterFunc(ctx, func() { t.Error("f should not be called") })
+	if !stop() || stop() {
+		t.Error("only the first call stops f")
+	}
+	cancel()
+
+	stop = afterFunc(context.Background(), func() {})
+	if !stop() || stop() {
+		t.Error("only the first call stops f")
+	}
+}
+
+func TestRunChildWaits(t *testing.T) {
+	// Dumpcap's exit status is reported after it's output was parsed
+	d := newMockcap(mockFailExitArg)
+	dev := Device{Name: "em1"}
+	if err := d.Capabilities(&dev, false); err != errFailExit {
+		t.Error(err)
+	}
+
+	// Dumpcap is killed if it's output can't be parsed
+	var child *mockCommand
+	d.newCommand = func(name string, arg ...string) Commander {
+		child = newMockCommand(name, append(arg, mockIllegalOutputArg)...).(*mockCommand)
+		return child
+	}
+	if err := d.TimestampTypes(&dev); err == nil {
+		t.Error("parsing should fail")
+	}
+	select {
+	case <-child.killed:
+	default:
+		t.Error("dumpcap should have been killed")
+	}
+}
+
+func TestCaptureCompression(t *testing.T) {
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: "foo.pcapng", SwitchOnFilesize: 1000,
+		Compression: UseGzipCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-c.Messages; msg.Type != FileMsg || msg.Text != "foo.pcapng" ||
+		msg.FinalFileName != "foo.pcapng.gz" {
+		t.Error(msg)
+	}
+	for range c.Messages {
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+
+	if c, err = d.NewCapture(Arguments{FileName: "foo.pcapng"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-c.Messages; msg.Type != FileMsg || msg.FinalFileName != msg.Text {
+		t.Error(msg)
+	}
+	for range c.Messages {
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCaptureRemote(t *testing.T) {
+	d := newMockcap()
+	da := DeviceArgument{Name: "rpcap://127.0.0.1/eth0", RemoteUDP: true,
+		SampleOneOf: 10}
+	c, err := d.NewCapture(Arguments{DeviceArgs: []DeviceArgument{da}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-c.Messages
+	var ce *CaptureError
+	if !errors.As(msg.Err(), &ce) || !strings.HasPrefix(ce.Secondary, "Authentication failed") {
+		t.Error(msg)
+	}
+	c.Wait()
+
+	da.RemoteUsername, da.RemotePassword = "mockuser", "mockpass"
+	if c, err = d.NewCapture(Arguments{DeviceArgs: []DeviceArgument{da}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-c.Messages; msg.Type != FileMsg {
+		t.Error(msg)
+	}
+	for range c.Messages {
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTimestampTypes(t *testing.T) {
+	d := newMockcap()
+	dev := Device{Name: "em1"}
+	if err := d.TimestampTypes(&dev); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.TimestampTypes) != 2 {
+		t.Fatal(dev.TimestampTypes)
+	}
+	if tt := dev.TimestampTypes[0]; tt.Name != "host" || tt.Description != "Host" {
+		t.Error(tt)
+	}
+	if tt := dev.TimestampTypes[1]; tt.String() != "adapter_unsynced" ||
+		tt.Description != "Adapter, not synced with system time" {
+		t.Error(tt)
+	}
+
+	d = newMockcap(mockIllegalOutputArg)
+	dev = Device{Name: "em1"}
+	var pe *ProtocolError
+	if err := d.TimestampTypes(&dev); !errors.As(err, &pe) || len(dev.TimestampTypes) != 0 {
+		t.Error(err, dev)
+	}
+}
+
 func TestReadPipeMessage(t *testing.T) {
 
 	// Empty reads results in EOF error
@@ -480,6 +1024,20 @@ func TestReadPipeMessage(t *testing.T) {
 	if msg.DropCount != 456 {
 		t.Error(msg.DropCount)
 	}
+	// The interface index is split from a bad filter's text
+	msg, err = readPipeMsg(bytes.NewReader(generateMsg(BadFilterMsg, "2:syntax error: foo")))
+	if msg.Type != BadFilterMsg {
+		t.Error(msg.Type)
+	}
+	if msg.InterfaceIndex != 2 || msg.Text != "syntax error: foo" {
+		t.Error(msg)
+	}
+
+	// Messages of unknown type are passed on
+	msg, err = readPipeMsg(bytes.NewReader([]byte{'X', 0, 0, 2, 1, 2}))
+	if err != nil || msg.Type != 'X' || !bytes.Equal(msg.Raw, []byte{1, 2}) {
+		t.Error(msg, err)
+	}
 }
 
 func TestBuildArgs(t *testing.T) {
@@ -489,12 +1047,12 @@ func TestBuildArgs(t *testing.T) {
 	}
 	args = Arguments{command: statsCmd, BufferedBytes: 123, CaptureFilter: "foobar",
 		EnableMonitorMode: true, FileFormat: UsePCAPNG,
-		StopOnDuration: 60, SwitchOnFiles: 5,
+		StopOnDuration: 60, SwitchOnFiles: 5, CaptureComments: []string{"foo"},
 		DeviceArgs: []DeviceArgument{{CaptureFilter: "barfoo",
 			DisablePromiscuousMode: true, KernelBufferSize: 456,
-			LinkLayerType: "llt", Name: "dev1"}}}
+			LinkLayerType: "llt", Name: "dev1", IfName: "bar", IfDescription: "baz"}}}
 	argString := strings.Join(args.buildArgs(), " ")
-	if argString != "-S -C 123 -f foobar -I -n -a duration:60 -b files:5 -i dev1 -p -B 456 -y llt" {
+	if argString != "-S -C 123 -f foobar -I -n -a duration:60 -b files:5 --capture-comment foo -i dev1 -f barfoo -p --ifdescr baz --ifname bar -B 456 -y llt" {
 		t.Error(argString)
 	}
 }
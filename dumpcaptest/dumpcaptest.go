@@ -0,0 +1,147 @@
+/* Dumpcap interface for golang
+Copyright (C) 2014 Lukas Lueg, lukas.lueg@gmail.com
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation; either version 3 of the License, or (at your option) any later
+version.
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+You should have received a copy of the GNU General Public License along with
+this program; if not, write to the Free Software Foundation, Inc., 51 Franklin
+Street, Fifth Floor, Boston, MA 02110-1301  USA
+*/
+
+/*
+Package dumpcaptest provides a fake dumpcap executable for integration tests
+on machines without the permission to capture traffic, or without dumpcap.
+The fake is a small program (see the fakedumpcap directory) which
+impersonates dumpcap as used by package dumpcap: It lists devices, reports
+their capabilities and statistics and "captures" packets, writing them to a
+file and reporting via the sync-pipe just like dumpcap. What it reports is
+taken from a Scenario.
+The fake reads the scenario from the JSON-file named by the environment
+variable DUMPCAPTEST_SCENARIO or, if unset, from "scenario.json" in the
+directory of it's executable.
+*/
+package dumpcaptest
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/lukaslueg/dumpcap"
+)
+
+// ScenarioEnv is the environment variable naming the scenario file.
+const ScenarioEnv = "DUMPCAPTEST_SCENARIO"
+
+// ScenarioFileName is the name of the scenario file searched next to the
+// executable.
+const ScenarioFileName = "scenario.json"
+
+// ExecutableName is the name of the executable built by Build.
+const ExecutableName = "dumpcap"
+
+// FakeImportPath is the import path of the fake's main package.
+const FakeImportPath = "github.com/lukaslueg/dumpcap/dumpcaptest/fakedumpcap"
+
+// Device describes a device known to the fake dumpcap.
+type Device struct {
+	Name           string                  // The name of the device, e.g. "eth0"
+	VendorName     string                  // The vendor's name, may be empty
+	FriendlyName   string                  // The human friendly name, may be empty
+	DevType        dumpcap.DeviceType      // The type of device
+	Addresses      []string                // The addresses of the device
+	Loopback       bool                    // True if the device is a loopback device
+	CanRFMon       bool                    // True if monitor-mode is supported
+	LinkLayers     []dumpcap.LinkLayerType // The link-layer types listed by "-L"; the first one is used for captures
+	TimestampTypes []dumpcap.TimestampType // The time stamp types listed by "--list-time-stamp-types"
+	PacketCount    uint64                  // The number of packets reported by "-S"
+	DropCount      uint64                  // The number of packets reported as dropped by "-S" and by captures
+	Error          string                  // If not empty, capturing from or querying the device fails with this error
+}
+
+// Scenario describes how the fake dumpcap behaves.
+type Scenario struct {
+	Version            string            // The output of "-v"
+	Help               string            // The output of "-h"
+	Devices            []Device          // The devices known to the fake
+	Filters            map[string]string // The BPF code printed by "-d" per capture filter; a program accepting all packets if not given
+	BadFilters         map[string]string // Capture filters which are refused, and the error reported for them
+	StatisticsInterval time.Duration     // The interval at which "-S" reports; one second if zero
+	Packets            [][]byte          // The packets written by a capture, as captured on the first device's first link-layer type
+	StopAfterPackets   bool              // Stop capturing once all packets are written instead of waiting for an interrupt
+	SystemDevices      bool              // Use the network interfaces of the system, or the network namespace, the fake runs in instead of Devices
+}
+
+// LoadScenario reads a scenario from the given JSON-file.
+func LoadScenario(name string) (*Scenario, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	if err = json.Unmarshal(buf, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save writes the scenario to the given JSON-file.
+func (s *Scenario) Save(name string) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, buf, 0644)
+}
+
+// Build compiles the fake dumpcap into the given directory using the go
+// tool and returns the path of the executable. The fake is built by it's
+// import path from the current working directory, so the version of package
+// dumpcap is the one the caller's module, or GOPATH, resolves it to.
+func Build(dir string) (string, error) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, ExecutableName)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	cmd := exec.Command(goTool, "build", "-o", name, FakeImportPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.New("dumpcaptest: building the fake dumpcap failed: " + string(out))
+	}
+	return name, nil
+}
+
+// New builds the fake dumpcap into a temporary directory, which is removed
+// once the test is done, writes the given scenario next to it and returns a
+// Dumpcap whose Executable is the fake. The test is skipped if the go tool is
+// not available.
+func New(tb testing.TB, scenario *Scenario) *dumpcap.Dumpcap {
+	tb.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		tb.Skip("the go tool is required to build the fake dumpcap: ", err)
+	}
+	dir := tb.TempDir()
+	name, err := Build(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = scenario.Save(filepath.Join(dir, ScenarioFileName)); err != nil {
+		tb.Fatal(err)
+	}
+	d := dumpcap.NewDumpcap()
+	d.Executable = name
+	return d
+}
@@ -0,0 +1,467 @@
+package dumpcaptest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lukaslueg/dumpcap"
+	"github.com/lukaslueg/dumpcap/capfile"
+)
+
+const bpfCode = "(000) ldh      [12]\n" +
+	"(001) jeq      #0x800           jt 2\tjf 3\n" +
+	"(002) ret      #262144\n" +
+	"(003) ret      #0\n"
+
+func testScenario() *Scenario {
+	return &Scenario{
+		Version: "Dumpcap (Wireshark) 4.2.2 (Git v4.2.2 packaged as 4.2.2-1).",
+		Devices: []Device{
+			{Name: "eth0", FriendlyName: "Ethernet", DevType: dumpcap.WiredDevice,
+				Addresses: []string{"192.0.2.1"}, CanRFMon: false,
+				LinkLayers: []dumpcap.LinkLayerType{{DLT: 1, Name: "EN10MB", Description: "Ethernet"},
+					{DLT: 143, Name: "DOCSIS", Description: "DOCSIS"}},
+				TimestampTypes: []dumpcap.TimestampType{{Name: "host", Description: "Host"}},
+				PacketCount:    123, DropCount: 4},
+			{Name: "lo", Loopback: true,
+				LinkLayers: []dumpcap.LinkLayerType{{DLT: 1, Name: "EN10MB", Description: "Ethernet"}}},
+			{Name: "wlan0", DevType: dumpcap.WirelessDevice, Error: "You don't have permission to capture on that device"},
+		},
+		Filters:            map[string]string{"ip": bpfCode},
+		BadFilters:         map[string]string{"port foo": "can't parse filter expression: syntax error"},
+		StatisticsInterval: 10 * time.Millisecond,
+		Packets:            [][]byte{[]byte("first packet"), []byte("second packet"), []byte("third packet")},
+	}
+}
+
+func TestVersionAndDevices(t *testing.T) {
+	d := New(t, testScenario())
+	if v, err := d.Version(); err != nil || !strings.HasPrefix(v, "Dumpcap (Wireshark) 4.2.2") {
+		t.Error(v, err)
+	}
+
+	devices, err := d.Devices(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 || devices[0].Name != "eth0" || devices[0].FriendlyName != "Ethernet" ||
+		devices[0].Addresses[0] != "192.0.2.1" || !devices[1].Loopback ||
+		devices[2].DevType != dumpcap.WirelessDevice {
+		t.Fatal(devices)
+	}
+
+	if err = d.Capabilities(&devices[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices[0].LLTs) != 2 || devices[0].LLTs[1].Name != "DOCSIS" || devices[0].CanRFMon {
+		t.Error(devices[0])
+	}
+	if err = d.TimestampTypes(&devices[0]); err != nil || len(devices[0].TimestampTypes) != 1 {
+		t.Error(devices[0], err)
+	}
+
+	// Monitor-mode is not supported by eth0, wlan0 is not accessible at all
+	var ce *dumpcap.CaptureError
+	if err = d.Capabilities(&devices[0], true); !errors.As(err, &ce) {
+		t.Error(err)
+	}
+	if err = d.Capabilities(&devices[2], false); !errors.As(err, &ce) ||
+		ce.Primary != "You don't have permission to capture on that device" {
+		t.Error(err)
+	}
+	if _, err = d.Devices(true); !errors.As(err, &ce) {
+		t.Error(err)
+	}
+}
+
+// copySource copies the package's source, which lives in the directory above,
+// to dir; a go.mod is written if there is none.
+func copySource(t *testing.T, dir string) {
+	root, err := filepath.Abs("..")
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() && strings.HasPrefix(e.Name(), ".") && path != root {
+			return filepath.SkipDir
+		}
+		if e.IsDir() || (filepath.Ext(path) != ".go" && e.Name() != "go.mod" && e.Name() != "go.sum") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Join(dir, filepath.Dir(rel)), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, rel), buf, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "go.mod")); os.IsNotExist(err) {
+		err = os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module github.com/lukaslueg/dumpcap\n\ngo 1.21\n"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildModule(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go tool is required to build the fake dumpcap: ", err)
+	}
+	// A module depending on package dumpcap, which is not to be found in
+	// GOPATH but only via the module's requirements
+	tmp := t.TempDir()
+	copySource(t, filepath.Join(tmp, "dumpcap"))
+	consumer := filepath.Join(tmp, "consumer")
+	if err := os.Mkdir(consumer, 0755); err != nil {
+		t.Fatal(err)
+	}
+	goMod := "module example.com/consumer\n\ngo 1.21\n\n" +
+		"require github.com/lukaslueg/dumpcap v0.0.0\n\n" +
+		"replace github.com/lukaslueg/dumpcap => ../dumpcap\n"
+	if err := os.WriteFile(filepath.Join(consumer, "go.mod"), []byte(goMod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOFLAGS", "-mod=mod")
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOWORK", "off")
+	t.Setenv("GOPATH", filepath.Join(tmp, "gopath"))
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(consumer); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	dir := t.TempDir()
+	name, err := Build(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testScenario().Save(filepath.Join(dir, ScenarioFileName)); err != nil {
+		t.Fatal(err)
+	}
+	d := dumpcap.NewDumpcap()
+	d.Executable = name
+	if v, err := d.Version(); err != nil || !strings.HasPrefix(v, "Dumpcap (Wireshark) 4.2.2") {
+		t.Error(v, err)
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	d := New(t, testScenario())
+	prog, err := d.CompileFilter("eth0", "", "ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.String() != bpfCode {
+		t.Error(prog)
+	}
+
+	var bfe *dumpcap.BadFilterError
+	if _, err = d.CompileFilter("eth0", "", "port foo"); !errors.As(err, &bfe) ||
+		bfe.Interface != "eth0" || bfe.Filter != "port foo" {
+		t.Error(err)
+	}
+}
+
+func TestCompileLargeFilter(t *testing.T) {
+	// The listing exceeds the capacity of a pipe, which dumpcap fills before
+	// reporting success
+	var b strings.Builder
+	for i := 0; i < 4000; i++ {
+		fmt.Fprintf(&b, "(%03d) ldh      [12]\n", i)
+	}
+	fmt.Fprintf(&b, "(%03d) ret      #0\n", 4000)
+	scenario := testScenario()
+	scenario.Filters["tcp"] = b.String()
+	d := New(t, scenario)
+	prog, err := d.CompileFilter("eth0", "", "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog.Instructions) != 4001 || prog.Instructions[4000].Opcode != "ret" {
+		t.Error(len(prog.Instructions))
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	d := New(t, testScenario())
+	stats, err := d.NewStatistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]dumpcap.DeviceStatistics)
+	for ds := range stats.Stats {
+		seen[ds.Name] = ds
+		if len(seen) == 3 {
+			break
+		}
+	}
+	if seen["eth0"].PacketCount != 123 || seen["eth0"].DropCount != 4 {
+		t.Error(seen)
+	}
+	if err = stats.Stop(5 * time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	d := New(t, testScenario())
+	fileName := filepath.Join(t.TempDir(), "capture.pcapng")
+	c, err := d.NewCapture(dumpcap.Arguments{FileName: fileName,
+		DeviceArgs: []dumpcap.DeviceArgument{{Name: "eth0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-c.Messages
+	if msg.Type != dumpcap.FileMsg || msg.Text != fileName {
+		t.Fatal(msg)
+	}
+	msg = <-c.Messages
+	if msg.Type != dumpcap.PacketCountMsg || msg.PacketCount != 3 {
+		t.Fatal(msg)
+	}
+
+	// The fake waits to be interrupted before reporting the drops
+	done := make(chan error)
+	go func() { done <- c.Stop(5 * time.Second) }()
+	msg = <-c.Messages
+	if msg.Type != dumpcap.DropCountMsg || msg.DropCount != 4 {
+		t.Error(msg)
+	}
+	for range c.Messages {
+	}
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+
+	r, err := capfile.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var count int
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p.Data) != string(testScenario().Packets[count]) {
+			t.Error(p)
+		}
+		count++
+	}
+	if r.Format() != capfile.PCAPNG || count != 3 || r.Interfaces()[0].LinkType != 1 {
+		t.Error(r.Format(), count)
+	}
+}
+
+func TestCaptureStdout(t *testing.T) {
+	scenario := testScenario()
+	scenario.StopAfterPackets = true
+	d := New(t, scenario)
+	c, err := d.NewCapture(dumpcap.Arguments{FileName: dumpcap.StdoutFileName,
+		FileFormat: dumpcap.UsePCAP, StopOnPacketCount: 2,
+		DeviceArgs: []dumpcap.DeviceArgument{{Name: "eth0", LinkLayerType: "DOCSIS"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range c.Messages {
+		}
+	}()
+
+	r := capfile.NewReader(c.Packets())
+	var count int
+	for {
+		if _, err := r.Next(); err != nil {
+			if err != io.EOF {
+				t.Error(err)
+			}
+			break
+		}
+		count++
+	}
+	if r.Format() != capfile.PCAP || count != 2 || r.Interfaces()[0].LinkType != 143 {
+		t.Error(r.Format(), count)
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCaptureFails(t *testing.T) {
+	d := New(t, testScenario())
+	for _, args := range []dumpcap.Arguments{
+		{DeviceArgs: []dumpcap.DeviceArgument{{Name: "eth0"}, {Name: "lo", CaptureFilter: "port foo"}}},
+		{DeviceArgs: []dumpcap.DeviceArgument{{Name: "wlan0"}}},
+		{DeviceArgs: []dumpcap.DeviceArgument{{Name: "eth1"}}},
+	} {
+		c, err := d.NewCapture(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := <-c.Messages
+		for range c.Messages {
+		}
+		var bfe *dumpcap.BadFilterError
+		var ce *dumpcap.CaptureError
+		if !errors.As(msg.Err(), &bfe) && !errors.As(msg.Err(), &ce) {
+			t.Error(args, msg)
+		}
+		if bfe != nil && (bfe.Interface != "lo" || bfe.Filter != "port foo") {
+			t.Error(bfe)
+		}
+		// Dumpcap exits with a non-zero status after reporting the error
+		var ee *dumpcap.ExitError
+		if err = c.Wait(); !errors.As(err, &ee) || ee.Code == 0 {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	d := New(t, testScenario())
+	r := dumpcap.NewRecorder(d)
+	devices, err := d.Devices(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Capabilities(&devices[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Capabilities(&devices[2], false); err == nil {
+		t.Fatal("capabilities of wlan0 should fail")
+	}
+
+	p := dumpcap.NewReplayer(r.Transcript())
+	replay := p.Dumpcap()
+	replayed, err := replay.Devices(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = replay.Capabilities(&replayed[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 3 || replayed[0].Name != "eth0" || len(replayed[0].LLTs) != 2 {
+		t.Error(replayed)
+	}
+	var ce *dumpcap.CaptureError
+	if err = replay.Capabilities(&replayed[2], false); !errors.As(err, &ce) {
+		t.Error(err)
+	}
+	if p.Remaining() != 0 {
+		t.Error(p.Remaining())
+	}
+}
+
+func TestNetNamespace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("network namespaces require Linux")
+	}
+	unshare, err := exec.LookPath("unshare")
+	if err != nil {
+		t.Skip(err)
+	}
+	if _, err = exec.LookPath("nsenter"); err != nil {
+		t.Skip(err)
+	}
+	if err = exec.Command(unshare, "-Urn", "true").Run(); err != nil {
+		t.Skip("unprivileged user and network namespaces are not available: ", err)
+	}
+
+	scenario := testScenario()
+	scenario.SystemDevices = true
+	scenario.StopAfterPackets = true
+	d := New(t, scenario)
+
+	// A process holding a new network namespace, owned by a new user
+	// namespace; the namespace contains nothing but a loopback device. The
+	// holder reports being ready only once unshare has written the user
+	// namespace's uid- and gid-maps, which nsenter requires to join it
+	holder := exec.Command(unshare, "-Urn", "sh", "-c", "echo; exec sleep 60")
+	ready, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		holder.Process.Kill()
+		holder.Wait()
+	}()
+	if _, err = bufio.NewReader(ready).ReadString('\n'); err != nil {
+		t.Fatal("the namespace was not created: ", err)
+	}
+	pid := strconv.Itoa(holder.Process.Pid)
+
+	d.NetNamespace = pid
+	devices, err := d.Devices(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Name != "lo" || !devices[0].Loopback {
+		t.Fatal(devices)
+	}
+
+	c, err := d.NewCapture(dumpcap.Arguments{FileName: dumpcap.StdoutFileName,
+		DeviceArgs: []dumpcap.DeviceArgument{{Name: "lo"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range c.Messages {
+		}
+	}()
+	r := capfile.NewReader(c.Packets())
+	var count int
+	for {
+		if _, err := r.Next(); err != nil {
+			if err != io.EOF {
+				t.Error(err)
+			}
+			break
+		}
+		count++
+	}
+	if count != len(scenario.Packets) {
+		t.Error(count)
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
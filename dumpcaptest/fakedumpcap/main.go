@@ -0,0 +1,463 @@
+// Command fakedumpcap impersonates dumpcap according to a scenario; see
+// package dumpcaptest.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lukaslueg/dumpcap"
+	"github.com/lukaslueg/dumpcap/dumpcaptest"
+	"github.com/lukaslueg/dumpcap/syncpipe"
+)
+
+// Options taking a value; all other options known to the fake are flags
+var valueOptions = map[string]bool{
+	"-a": true, "-A": true, "-b": true, "-B": true, "-c": true, "-C": true,
+	"-f": true, "-i": true, "-k": true, "-m": true, "-N": true, "-s": true,
+	"-w": true, "-y": true, "-Z": true,
+	"--capture-comment": true, "--compress-type": true, "--ifdescr": true,
+	"--ifname": true, "--temp-dir": true, "--time-stamp-precision": true,
+	"--time-stamp-type": true,
+}
+
+var flagOptions = map[string]bool{
+	"-d": true, "-D": true, "-g": true, "-h": true, "-I": true, "-L": true,
+	"-M": true, "-n": true, "-p": true, "-P": true, "-r": true, "-S": true,
+	"-t": true, "-u": true, "-v": true, "--list-time-stamp-types": true,
+}
+
+// The default BPF code printed by "-d", accepting all packets
+const acceptAll = "(000) ret      #262144\n"
+
+// iface represents an interface given by "-i" and it's options.
+type iface struct {
+	name      string
+	filter    string
+	linkLayer string
+}
+
+// fake holds the scenario and the parsed commandline.
+type fake struct {
+	scenario    *dumpcaptest.Scenario
+	command     string
+	child       bool
+	monitorMode bool
+	fileName    string
+	filter      string
+	linkLayer   string
+	pcap        bool
+	packetLimit uint64
+	tempDir     string
+	ifaces      []iface
+	stderr      *syncpipe.Writer
+}
+
+func main() {
+	name := os.Getenv(dumpcaptest.ScenarioEnv)
+	if name == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "dumpcap:", err)
+			os.Exit(1)
+		}
+		name = filepath.Join(filepath.Dir(exe), dumpcaptest.ScenarioFileName)
+	}
+	scenario, err := dumpcaptest.LoadScenario(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dumpcap: can't read scenario:", err)
+		os.Exit(1)
+	}
+
+	if scenario.SystemDevices {
+		if scenario.Devices, err = systemDevices(); err != nil {
+			fmt.Fprintln(os.Stderr, "dumpcap: can't list interfaces:", err)
+			os.Exit(1)
+		}
+	}
+
+	f := &fake{scenario: scenario, stderr: syncpipe.NewWriter(os.Stderr)}
+	f.parseArgs(os.Args[1:])
+	switch f.command {
+	case "-v":
+		fmt.Println(scenario.Version)
+	case "-h":
+		fmt.Print(scenario.Help)
+	case "-D":
+		f.listDevices()
+	case "-L":
+		f.listLayers()
+	case "--list-time-stamp-types":
+		f.listTimestampTypes()
+	case "-d":
+		f.compileFilter()
+	case "-S":
+		f.statistics()
+	default:
+		f.capture()
+	}
+}
+
+// fail reports an error like dumpcap does and exits.
+func (f *fake) fail(primary, secondary string) {
+	if f.child {
+		_ = f.stderr.WriteMessage(&syncpipe.Message{Type: syncpipe.ErrMsg,
+			Primary: primary, Secondary: secondary})
+	} else {
+		fmt.Fprintln(os.Stderr, "dumpcap:", primary)
+		if secondary != "" {
+			fmt.Fprintln(os.Stderr, secondary)
+		}
+	}
+	os.Exit(1)
+}
+
+// send writes a message to the sync-pipe if running in child-mode.
+func (f *fake) send(msg *syncpipe.Message) {
+	if f.child {
+		_ = f.stderr.WriteMessage(msg)
+	}
+}
+
+func (f *fake) parseArgs(args []string) {
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		if flagOptions[opt] {
+			switch opt {
+			case "-d", "-D", "-h", "-L", "-S", "-v", "--list-time-stamp-types":
+				f.command = opt
+			case "-I":
+				f.monitorMode = true
+			case "-P":
+				f.pcap = true
+			}
+			continue
+		}
+		if !valueOptions[opt] || i+1 == len(args) {
+			fmt.Fprintf(os.Stderr, "dumpcap: invalid option -- '%s'\n", strings.TrimLeft(opt, "-"))
+			os.Exit(1)
+		}
+		i++
+		value := args[i]
+		var current *iface
+		if len(f.ifaces) > 0 {
+			current = &f.ifaces[len(f.ifaces)-1]
+		}
+		switch opt {
+		case "-Z":
+			f.child = true
+		case "-i":
+			f.ifaces = append(f.ifaces, iface{name: value})
+		case "-f":
+			if current != nil {
+				current.filter = value
+			} else {
+				f.filter = value
+			}
+		case "-y":
+			if current != nil {
+				current.linkLayer = value
+			} else {
+				f.linkLayer = value
+			}
+		case "-w":
+			f.fileName = value
+		case "--temp-dir":
+			f.tempDir = value
+		case "-c":
+			f.packetLimit, _ = strconv.ParseUint(value, 10, 64)
+		case "-a":
+			if strings.HasPrefix(value, "packets:") {
+				f.packetLimit, _ = strconv.ParseUint(value[len("packets:"):], 10, 64)
+			}
+		}
+	}
+	if len(f.ifaces) == 0 && len(f.scenario.Devices) > 0 {
+		// Like dumpcap, use the first device by default
+		f.ifaces = []iface{{name: f.scenario.Devices[0].Name}}
+	}
+	for i := range f.ifaces {
+		if f.ifaces[i].filter == "" {
+			f.ifaces[i].filter = f.filter
+		}
+		if f.ifaces[i].linkLayer == "" {
+			f.ifaces[i].linkLayer = f.linkLayer
+		}
+	}
+}
+
+// systemDevices returns the network interfaces of the network namespace the
+// fake runs in, all capturing Ethernet.
+func systemDevices() ([]dumpcaptest.Device, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]dumpcaptest.Device, 0, len(ifaces))
+	for _, ifc := range ifaces {
+		dev := dumpcaptest.Device{Name: ifc.Name, Loopback: ifc.Flags&net.FlagLoopback != 0,
+			LinkLayers: []dumpcap.LinkLayerType{{DLT: 1, Name: "EN10MB", Description: "Ethernet"}}}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				dev.Addresses = append(dev.Addresses, ipnet.IP.String())
+			}
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// device returns the scenario's device of the given name; fails if there is
+// none or if it is configured to fail.
+func (f *fake) device(name string) *dumpcaptest.Device {
+	for i, dev := range f.scenario.Devices {
+		if dev.Name == name {
+			if dev.Error != "" {
+				f.fail(dev.Error, "")
+			}
+			return &f.scenario.Devices[i]
+		}
+	}
+	f.fail(fmt.Sprintf("The capture session could not be initiated on interface '%s' (No such device exists).", name),
+		"Please check that you have the proper interface specified.")
+	return nil
+}
+
+// firstDevice returns the device given first.
+func (f *fake) firstDevice() *dumpcaptest.Device {
+	if len(f.ifaces) == 0 {
+		f.fail("There are no interfaces on which a capture can be done.", "")
+	}
+	return f.device(f.ifaces[0].name)
+}
+
+// checkFilters fails with a BadFilterMsg if a capture filter is refused.
+func (f *fake) checkFilters() {
+	for i, ifc := range f.ifaces {
+		if msg, bad := f.scenario.BadFilters[ifc.filter]; bad {
+			f.send(&syncpipe.Message{Type: syncpipe.BadFilterMsg, InterfaceIndex: i, Text: msg})
+			os.Exit(2)
+		}
+	}
+}
+
+func (f *fake) listDevices() {
+	for i, dev := range f.scenario.Devices {
+		kind := "network"
+		if dev.Loopback {
+			kind = "loopback"
+		}
+		fmt.Printf("%d. %s\t%s\t%s\t%d\t%s\t%s\n", i+1, dev.Name, dev.VendorName,
+			dev.FriendlyName, dev.DevType, strings.Join(dev.Addresses, ","), kind)
+	}
+}
+
+func (f *fake) listLayers() {
+	dev := f.firstDevice()
+	if f.monitorMode && !dev.CanRFMon {
+		f.fail(fmt.Sprintf("The capture session could not be initiated on interface '%s' (That device doesn't support monitor mode).", dev.Name), "")
+	}
+	f.send(&syncpipe.Message{Type: syncpipe.SuccessMsg})
+	canRFMon := 0
+	if dev.CanRFMon {
+		canRFMon = 1
+	}
+	fmt.Println(canRFMon)
+	for _, llt := range dev.LinkLayers {
+		fmt.Printf("%d\t%s\t%s\n", llt.DLT, llt.Name, llt.Description)
+	}
+}
+
+func (f *fake) listTimestampTypes() {
+	dev := f.firstDevice()
+	f.send(&syncpipe.Message{Type: syncpipe.SuccessMsg})
+	for _, tt := range dev.TimestampTypes {
+		fmt.Printf("%s\t%s\n", tt.Name, tt.Description)
+	}
+}
+
+func (f *fake) compileFilter() {
+	f.firstDevice()
+	f.checkFilters()
+	code, ok := f.scenario.Filters[f.ifaces[0].filter]
+	if !ok {
+		code = acceptAll
+	}
+	// Like dumpcap, print the code before reporting success
+	fmt.Print(code)
+	f.send(&syncpipe.Message{Type: syncpipe.SuccessMsg})
+}
+
+// notifyStop returns a channel which receives once dumpcap is asked to stop.
+func notifyStop() <-chan os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	return stop
+}
+
+func (f *fake) statistics() {
+	stop := notifyStop()
+	interval := f.scenario.StatisticsInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	f.send(&syncpipe.Message{Type: syncpipe.SuccessMsg})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, dev := range f.scenario.Devices {
+			if _, err := fmt.Printf("%s\t%d\t%d\n", dev.Name, dev.PacketCount, dev.DropCount); err != nil {
+				// The parent closed the pipe
+				return
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// linkType returns the DLT packets are written with.
+func (f *fake) linkType(dev *dumpcaptest.Device) uint {
+	for _, llt := range dev.LinkLayers {
+		if f.ifaces[0].linkLayer == "" || llt.Name == f.ifaces[0].linkLayer {
+			return llt.DLT
+		}
+	}
+	if f.ifaces[0].linkLayer != "" {
+		f.fail(fmt.Sprintf("The capture session could not be initiated on interface '%s' (Unsupported link-layer type %s).",
+			dev.Name, f.ifaces[0].linkLayer), "")
+	}
+	return 1 // Ethernet
+}
+
+// openOutput opens the file captured packets are written to and returns it's
+// name.
+func (f *fake) openOutput() (io.WriteCloser, string) {
+	switch f.fileName {
+	case "-":
+		return os.Stdout, f.fileName
+	case "":
+		suffix := ".pcapng"
+		if f.pcap {
+			suffix = ".pcap"
+		}
+		file, err := os.CreateTemp(f.tempDir, "wireshark_"+f.ifaces[0].name+"_*"+suffix)
+		if err != nil {
+			f.fail("The temporary file to which the capture would be saved could not be opened.", err.Error())
+		}
+		return file, file.Name()
+	default:
+		file, err := os.Create(f.fileName)
+		if err != nil {
+			f.fail(fmt.Sprintf("The file to which the capture would be saved (\"%s\") could not be opened.", f.fileName), err.Error())
+		}
+		return file, f.fileName
+	}
+}
+
+func (f *fake) capture() {
+	stop := notifyStop()
+	dev := f.firstDevice()
+	for _, ifc := range f.ifaces[1:] {
+		f.device(ifc.name)
+	}
+	f.checkFilters()
+	linkType := f.linkType(dev)
+
+	packets := f.scenario.Packets
+	if f.packetLimit != 0 && uint64(len(packets)) > f.packetLimit {
+		packets = packets[:f.packetLimit]
+	}
+	out, name := f.openOutput()
+	f.send(&syncpipe.Message{Type: syncpipe.FileMsg, Text: name})
+	if f.pcap {
+		writePCAP(out, uint32(linkType), packets)
+	} else {
+		writePCAPNG(out, uint16(linkType), packets)
+	}
+	if out != os.Stdout {
+		_ = out.Close()
+	}
+	f.send(&syncpipe.Message{Type: syncpipe.PacketCountMsg, Count: uint64(len(packets))})
+
+	if !f.scenario.StopAfterPackets && (f.packetLimit == 0 || uint64(len(packets)) < f.packetLimit) {
+		<-stop
+	}
+	if out == os.Stdout {
+		_ = out.Close()
+	}
+	var drops uint64
+	for _, ifc := range f.ifaces {
+		drops += f.device(ifc.name).DropCount
+	}
+	f.send(&syncpipe.Message{Type: syncpipe.DropCountMsg, Count: drops})
+}
+
+// writePCAP writes the given packets in PCAP format.
+func writePCAP(w io.Writer, linkType uint32, packets [][]byte) {
+	var b bytes.Buffer
+	order := binary.LittleEndian
+	binary.Write(&b, order, []uint32{0xa1b2c3d4})
+	binary.Write(&b, order, []uint16{2, 4})
+	binary.Write(&b, order, []uint32{0, 0, 262144, linkType})
+	now := time.Now()
+	for _, p := range packets {
+		binary.Write(&b, order, []uint32{uint32(now.Unix()), uint32(now.Nanosecond() / 1000),
+			uint32(len(p)), uint32(len(p))})
+		b.Write(p)
+	}
+	_, _ = w.Write(b.Bytes())
+}
+
+// writePCAPNG writes the given packets in PCAP-ng format, using a single
+// interface with microsecond resolution.
+func writePCAPNG(w io.Writer, linkType uint16, packets [][]byte) {
+	var b bytes.Buffer
+	order := binary.LittleEndian
+	block := func(blockType uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		binary.Write(&b, order, []uint32{blockType, uint32(len(body) + 12)})
+		b.Write(body)
+		binary.Write(&b, order, uint32(len(body)+12))
+	}
+
+	var body bytes.Buffer
+	binary.Write(&body, order, uint32(0x1a2b3c4d))
+	binary.Write(&body, order, []uint16{1, 0})
+	binary.Write(&body, order, int64(-1))
+	block(0x0a0d0d0a, body.Bytes())
+
+	body.Reset()
+	binary.Write(&body, order, []uint16{linkType, 0})
+	binary.Write(&body, order, uint32(262144))
+	block(1, body.Bytes())
+
+	ts := uint64(time.Now().UnixNano() / 1000)
+	for _, p := range packets {
+		body.Reset()
+		binary.Write(&body, order, []uint32{0, uint32(ts >> 32), uint32(ts),
+			uint32(len(p)), uint32(len(p))})
+		body.Write(p)
+		block(6, body.Bytes())
+	}
+	_, _ = w.Write(b.Bytes())
+}
@@ -0,0 +1,75 @@
+package dumpcap
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CaptureError is reported by dumpcap if it fails to do what it was asked
+// for, e.g. because of missing permissions to capture on a device.
+type CaptureError struct {
+	Primary   string // A short description of the problem
+	Secondary string // Details and hints on how to solve the problem; may be empty
+}
+
+func (e *CaptureError) Error() string {
+	if e.Secondary == "" {
+		return e.Primary
+	}
+	return e.Primary + ": " + e.Secondary
+}
+
+// BadFilterError is reported by dumpcap if a capture filter can't be
+// compiled.
+type BadFilterError struct {
+	Interface string // The interface the filter was given for, if known
+	Filter    string // The offending filter, if known
+	Message   string // The error reported by dumpcap
+}
+
+func (e *BadFilterError) Error() string {
+	s := "bad capture filter"
+	if e.Filter != "" {
+		s += fmt.Sprintf(" %q", e.Filter)
+	}
+	if e.Interface != "" {
+		s += " on " + e.Interface
+	}
+	return s + ": " + e.Message
+}
+
+// ProtocolError is returned if the output of dumpcap can't be decoded.
+type ProtocolError struct {
+	Offset int64  // The offset of the offending output in the stream it was read from
+	Raw    []byte // The offending output
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("illegal output from dumpcap at offset %d: %q", e.Offset, e.Raw)
+}
+
+// ExitError is returned if dumpcap exits with a non-zero status.
+type ExitError struct {
+	Code   int    // The exit status; -1 if dumpcap was terminated by a signal
+	Stderr string // The output dumpcap wrote to it's standard error, if it was not read otherwise
+}
+
+func (e *ExitError) Error() string {
+	s := fmt.Sprintf("dumpcap exited with status %d", e.Code)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		s += ": " + stderr
+	}
+	return s
+}
+
+// newExitError converts an *exec.ExitError into an *ExitError; all other
+// errors are returned unchanged.
+func newExitError(err error) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return err
+	}
+	return &ExitError{Code: ee.ExitCode(), Stderr: string(ee.Stderr)}
+}
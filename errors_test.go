@@ -0,0 +1,101 @@
+package dumpcap
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/lukaslueg/dumpcap/syncpipe"
+)
+
+func TestErrorMessages(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{&CaptureError{Primary: "foo"}, "foo"},
+		{&CaptureError{Primary: "foo", Secondary: "bar"}, "foo: bar"},
+		{&BadFilterError{Message: "syntax error"}, "bad capture filter: syntax error"},
+		{&BadFilterError{Interface: "eth0", Filter: "port foo", Message: "syntax error"},
+			`bad capture filter "port foo" on eth0: syntax error`},
+		{&ProtocolError{Offset: 12, Raw: []byte("foobar")},
+			`illegal output from dumpcap at offset 12: "foobar"`},
+		{&ExitError{Code: 1}, "dumpcap exited with status 1"},
+		{&ExitError{Code: 2, Stderr: "no such option\n"}, "dumpcap exited with status 2: no such option"},
+	} {
+		if tc.err.Error() != tc.expected {
+			t.Error(tc.err)
+		}
+	}
+}
+
+func TestPipeMessageErr(t *testing.T) {
+	msg, err := readPipeMsg(bytes.NewReader(generateErrorMsg(errText1, errText2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ce *CaptureError
+	if !errors.As(msg.Err(), &ce) || ce.Primary != errText1 || ce.Secondary != errText2 {
+		t.Error(msg.Err())
+	}
+
+	msg, err = readPipeMsg(bytes.NewReader(generateMsg(BadFilterMsg, errText1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.InterfaceIndex != -1 || msg.Text != errText1 {
+		t.Error(msg)
+	}
+	var bfe *BadFilterError
+	if !errors.As(msg.Err(), &bfe) || bfe.Message != errText1 {
+		t.Error(msg.Err())
+	}
+
+	if err = (PipeMessage{Type: FileMsg}).Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaitForSuccessMsgErrors(t *testing.T) {
+	var ce *CaptureError
+	if err := waitForSuccessMsg(bytes.NewReader(generateErrorMsg(errText1, errText2)), Arguments{}); !errors.As(err, &ce) {
+		t.Error(err)
+	}
+	var bfe *BadFilterError
+	args := Arguments{DeviceArgs: []DeviceArgument{{Name: "em1", CaptureFilter: "port foo"}}}
+	if err := waitForSuccessMsg(bytes.NewReader(generateMsg(BadFilterMsg, "0:"+errText1)), args); !errors.As(err, &bfe) ||
+		bfe.Interface != "em1" || bfe.Filter != "port foo" {
+		t.Error(err)
+	}
+	// Messages of unknown type preceding the success-message are skipped
+	input := append([]byte{'X', 0, 0, 1, 0}, generateMsg(SuccessMsg, successText)...)
+	if err := waitForSuccessMsg(bytes.NewReader(input), args); err != nil {
+		t.Error(err)
+	}
+	// Gibberish is not
+	if err := waitForSuccessMsg(bytes.NewReader([]byte(gibberish)), args); !errors.Is(err, syncpipe.ErrInvalidHeader) {
+		t.Error(err)
+	}
+}
+
+func TestExitError(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	_, err = NewOSCommand(sh, "-c", "echo oops >&2; exit 3").Output()
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.Code != 3 || ee.Stderr != "oops\n" {
+		t.Error(err)
+	}
+
+	err = NewOSCommand(sh, "-c", "exit 4").Run()
+	if !errors.As(err, &ee) || ee.Code != 4 {
+		t.Error(err)
+	}
+
+	if err = NewOSCommand(sh, "-c", "exit 0").Run(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+// Capture traffic from loopback interface for some time and print the
+// captured packets as dumpcap reports them, without the need for libpcap
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lukaslueg/dumpcap"
+)
+
+func main() {
+	fmt.Println(dumpcap.VersionString())
+
+	// Setup dumpcap to capture on loopback for ten seconds, switching between
+	// files every three seconds.
+	args := dumpcap.Arguments{
+		DeviceArgs:       []dumpcap.DeviceArgument{{Name: "lo"}},
+		FileName:         "/tmp/foobar",
+		SwitchOnDuration: 3,
+		StopOnDuration:   10}
+
+	c, err := dumpcap.NewCapture(args)
+	if err != nil {
+		panic(err)
+	}
+
+	// The stream follows dumpcap from file to file and reads exactly the
+	// number of packets dumpcap has reported.
+	ps := c.PacketStream()
+	for item := range ps.Items {
+		if item.Packet == nil {
+			log.Println("Dumpcap has dropped", item.DropCount, "packets so far")
+			continue
+		}
+		log.Println(item.FileName, item.Packet.Timestamp, item.Packet.OrigLen)
+	}
+	if err = ps.Err(); err != nil {
+		c.Kill()
+		log.Fatal(err)
+	}
+
+	if err = c.Wait(); err != nil {
+		log.Fatal(err)
+	} else {
+		log.Println("Dumpcap has exited normally")
+	}
+}
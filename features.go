@@ -0,0 +1,230 @@
+package dumpcap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// used to find options like "-i" or "--ifname" in a line of "dumpcap -h"
+var helpOptionRE = regexp.MustCompile(`(?:^|[\s,])(--?[A-Za-z][\w-]*)`)
+
+// used to find conditions like "interval:NUM - ..." in the lines following
+// "-a" or "-b" in "dumpcap -h"; older versions print the first condition on
+// the line of the option itself
+var helpConditionRE = regexp.MustCompile(`(?:^|\s)([a-z]+):\S+\s+-\s`)
+
+// Features describes the options supported by a specific dumpcap executable.
+type Features struct {
+	Version *VersionInfo
+	options map[string]bool
+}
+
+// Supports returns true if dumpcap supports the given option, e.g. "-k" or
+// "--ifname". Conditions for ringbuffers and autostop are given as
+// e.g. "-b interval" or "-a packets".
+func (f *Features) Supports(option string) bool {
+	return f.options[option]
+}
+
+// UnsupportedError is returned if a field of Arguments requires an option
+// the installed dumpcap does not support.
+type UnsupportedError struct {
+	Field   string // The field of Arguments, e.g. "DeviceArgs[0].WiFiChannel"
+	Option  string // The option required by the field, e.g. "-k"
+	Version string // The version of dumpcap
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("dumpcap %s does not support %s required by %s",
+		e.Version, e.Option, e.Field)
+}
+
+// argumentFeature associates a field of Arguments with the option it requires
+type argumentFeature struct {
+	field  string
+	option string
+	used   func(a Arguments) bool
+}
+
+// deviceArgumentFeature associates a field of DeviceArgument with the option
+// it requires
+type deviceArgumentFeature struct {
+	field  string
+	option string
+	used   func(da DeviceArgument) bool
+}
+
+// The options required by the fields of Arguments.
+var argumentFeatures = []argumentFeature{
+	{"BufferedBytes", bufferedBytesArg, func(a Arguments) bool { return a.BufferedBytes != 0 }},
+	{"BufferedPackets", bufferedPacketsArg, func(a Arguments) bool { return a.BufferedPackets != 0 }},
+	{"CaptureComments", captureCommentArg, func(a Arguments) bool { return len(a.CaptureComments) != 0 }},
+	{"CaptureFilter", captureFilterArg, func(a Arguments) bool { return a.CaptureFilter != "" }},
+	{"Compression", compressTypeArg, func(a Arguments) bool { return a.Compression != NoCompression }},
+	{"DisablePromiscuousMode", disablePromiscuousArg, func(a Arguments) bool { return a.DisablePromiscuousMode }},
+	{"EnableGroupAccess", enableGroupAccessArg, func(a Arguments) bool { return a.EnableGroupAccess }},
+	{"EnableMonitorMode", enableMonitorModeArg, func(a Arguments) bool { return a.EnableMonitorMode }},
+	{"FileFormat", usePCAPArg, func(a Arguments) bool { return a.FileFormat == UsePCAP }},
+	{"FileFormat", usePCAPNGArg, func(a Arguments) bool { return a.FileFormat == UsePCAPNG }},
+	{"KernelBufferSize", kernelBufferSizeArg, func(a Arguments) bool { return a.KernelBufferSize != 0 }},
+	{"LinkLayerType", linkLayerTypeArg, func(a Arguments) bool { return a.LinkLayerType != "" }},
+	{"RingbufferNameTimeNum", ringbufferArg + " " + nameTimeNumArg, func(a Arguments) bool { return a.RingbufferNameTimeNum }},
+	{"RingbufferPrintName", ringbufferArg + " " + printNameArg, func(a Arguments) bool { return a.RingbufferPrintName != "" }},
+	{"SnapshotLength", snaplenArg, func(a Arguments) bool { return a.SnapshotLength != 0 }},
+	{"StopOnDuration", autoStopConditionArg + " " + durationArg, func(a Arguments) bool { return a.StopOnDuration != 0 }},
+	{"StopOnFiles", autoStopConditionArg + " " + filesArg, func(a Arguments) bool { return a.StopOnFiles != 0 }},
+	{"StopOnFilesize", autoStopConditionArg + " " + filesizeArg, func(a Arguments) bool { return a.StopOnFilesize != 0 }},
+	{"StopOnInterval", autoStopConditionArg + " " + intervalArg, func(a Arguments) bool { return a.StopOnInterval != 0 }},
+	{"StopOnPacketCount", packetCountArg, func(a Arguments) bool { return a.StopOnPacketCount != 0 }},
+	{"StopOnPackets", autoStopConditionArg + " " + packetsArg, func(a Arguments) bool { return a.StopOnPackets != 0 }},
+	{"SwitchOnDuration", ringbufferArg + " " + durationArg, func(a Arguments) bool { return a.SwitchOnDuration != 0 }},
+	{"SwitchOnFiles", ringbufferArg + " " + filesArg, func(a Arguments) bool { return a.SwitchOnFiles != 0 }},
+	{"SwitchOnFilesize", ringbufferArg + " " + filesizeArg, func(a Arguments) bool { return a.SwitchOnFilesize != 0 }},
+	{"SwitchOnInterval", ringbufferArg + " " + intervalArg, func(a Arguments) bool { return a.SwitchOnInterval != 0 }},
+	{"SwitchOnPackets", ringbufferArg + " " + packetsArg, func(a Arguments) bool { return a.SwitchOnPackets != 0 }},
+	{"TempDir", tempDirArg, func(a Arguments) bool { return a.TempDir != "" }},
+	{"UseThreads", useThreadsArg, func(a Arguments) bool { return a.UseThreads }},
+	{"WiFiChannel", wifiChannelArg, func(a Arguments) bool { return a.WiFiChannel != "" }},
+}
+
+// The options required by the fields of DeviceArgument.
+var deviceArgumentFeatures = []deviceArgumentFeature{
+	{"CaptureFilter", captureFilterArg, func(da DeviceArgument) bool { return da.CaptureFilter != "" }},
+	{"DisablePromiscuousMode", disablePromiscuousArg, func(da DeviceArgument) bool { return da.DisablePromiscuousMode }},
+	{"EnableMonitorMode", enableMonitorModeArg, func(da DeviceArgument) bool { return da.EnableMonitorMode }},
+	{"IfDescription", ifDescriptionArg, func(da DeviceArgument) bool { return da.IfDescription != "" }},
+	{"IfName", ifNameArg, func(da DeviceArgument) bool { return da.IfName != "" }},
+	{"KernelBufferSize", kernelBufferSizeArg, func(da DeviceArgument) bool { return da.KernelBufferSize != 0 }},
+	{"LinkLayerType", linkLayerTypeArg, func(da DeviceArgument) bool { return da.LinkLayerType != "" }},
+	{"NanosecondTimestamps", timestampPrecisionArg, func(da DeviceArgument) bool { return da.NanosecondTimestamps }},
+	{"RemoteCaptureOwnTraffic", remoteCaptureOwnTrafficArg, func(da DeviceArgument) bool { return da.RemoteCaptureOwnTraffic }},
+	{"RemoteUDP", remoteUDPArg, func(da DeviceArgument) bool { return da.RemoteUDP }},
+	{"RemoteUsername", remoteAuthArg, func(da DeviceArgument) bool { return da.RemoteUsername != "" }},
+	{"SampleInterval", samplingArg + " " + timerArg, func(da DeviceArgument) bool { return da.SampleInterval != 0 }},
+	{"SampleOneOf", samplingArg + " " + countArg, func(da DeviceArgument) bool { return da.SampleOneOf != 0 }},
+	{"SnapshotLength", snaplenArg, func(da DeviceArgument) bool { return da.SnapshotLength != 0 }},
+	{"TimestampType", timestampTypeArg, func(da DeviceArgument) bool { return da.TimestampType != "" }},
+	{"WiFiChannel", wifiChannelArg, func(da DeviceArgument) bool { return da.WiFiChannel != "" }},
+}
+
+// Check returns an *UnsupportedError for the first field of the given
+// Arguments which requires an option dumpcap does not support.
+func (f *Features) Check(args Arguments) error {
+	if len(f.options) == 0 {
+		// Nothing is known about dumpcap's options
+		return nil
+	}
+	var version string
+	if f.Version != nil {
+		version = f.Version.String()
+	}
+
+	for _, af := range argumentFeatures {
+		if af.used(args) && !f.Supports(af.option) {
+			return &UnsupportedError{Field: af.field, Option: af.option, Version: version}
+		}
+	}
+	for i, da := range args.DeviceArgs {
+		for _, df := range deviceArgumentFeatures {
+			if df.used(da) && !f.Supports(df.option) {
+				return &UnsupportedError{
+					Field:   fmt.Sprintf("DeviceArgs[%d].%s", i, df.field),
+					Option:  df.option,
+					Version: version}
+			}
+		}
+	}
+	return nil
+}
+
+// parseHelp collects the options found in the output of "dumpcap -h".
+func parseHelp(output string) map[string]bool {
+	options := make(map[string]bool)
+	var current string
+	for _, line := range strings.Split(strings.Replace(output, "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(line, "  -") {
+			// An option like "  -i <interface>, --interface <interface>",
+			// possibly followed by it's description or, as in
+			// "  -b <ringbuffer opt.> ... duration:NUM - switch ...", by
+			// it's first condition
+			spec := line[2:]
+			var condition string
+			if m := helpConditionRE.FindStringSubmatchIndex(spec); m != nil {
+				condition = spec[m[2]:m[3]]
+				spec = spec[:m[0]]
+			}
+			if i := strings.Index(spec, "  "); i >= 0 {
+				spec = spec[:i]
+			}
+			current = ""
+			for _, m := range helpOptionRE.FindAllStringSubmatch(spec, -1) {
+				if current == "" {
+					current = m[1]
+				}
+				options[m[1]] = true
+			}
+			if current != "" && condition != "" {
+				options[current+" "+condition] = true
+			}
+			continue
+		}
+		if current == "" {
+			continue
+		}
+		if m := helpConditionRE.FindStringSubmatch(line); m != nil {
+			options[current+" "+m[1]] = true
+		}
+	}
+	return options
+}
+
+// featureCache holds the result of Features() for use by other goroutines.
+type featureCache struct {
+	mu       sync.Mutex
+	features *Features
+}
+
+// get returns the cached features, nil if there are none.
+func (fc *featureCache) get() *Features {
+	if fc == nil {
+		return nil
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.features
+}
+
+// set caches the given features unless there are some already, which are
+// returned instead.
+func (fc *featureCache) set(f *Features) *Features {
+	if fc == nil {
+		return f
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.features == nil {
+		fc.features = f
+	}
+	return fc.features
+}
+
+// Features calls dumpcap to find out about the options it supports. The
+// result is cached; once Features was called successfully, NewCapture
+// refuses Arguments which dumpcap does not support with an *UnsupportedError
+// before dumpcap is started. NewCapture does not call Features by itself.
+func (d *Dumpcap) Features() (*Features, error) {
+	if f := d.features.get(); f != nil {
+		return f, nil
+	}
+	v, err := d.VersionInfo()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := d.command(helpCmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	return d.features.set(&Features{Version: v, options: parseHelp(string(buf))}), nil
+}
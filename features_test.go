@@ -0,0 +1,258 @@
+package dumpcap
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// The help of dumpcap 3.6 on a system without libnl, lacking "-k"
+const helpOutput = "Dumpcap (Wireshark) 3.6.2 (Git v3.6.2 packaged as 3.6.2-2)\n" +
+	"Capture network packets and dump them into a pcapng or pcap file.\n" +
+	"See https://www.wireshark.org for more information.\n" +
+	"\n" +
+	"Usage: dumpcap [options] ...\n" +
+	"\n" +
+	"Capture interface:\n" +
+	"  -i <interface>, --interface <interface>\n" +
+	"                           name or idx of interface (def: first non-loopback),\n" +
+	"                           or for remote capturing, use one of these formats:\n" +
+	"                               rpcap://<host>/<interface>\n" +
+	"                               TCP@<host>:<port>\n" +
+	"  --ifname <name>          name to use in the capture file for a pipe from which\n" +
+	"                           we're capturing\n" +
+	"  --ifdescr <description>\n" +
+	"                           description to use in the capture file for a pipe\n" +
+	"                           from which we're capturing\n" +
+	"  -f <capture filter>      packet filter in libpcap filter syntax\n" +
+	"  -s <snaplen>, --snapshot-length <snaplen>\n" +
+	"                           packet snapshot length (def: appropriate maximum)\n" +
+	"  -p, --no-promiscuous-mode\n" +
+	"                           don't capture in promiscuous mode\n" +
+	"  -I, --monitor-mode       capture in monitor mode, if available\n" +
+	"  -B <buffer size>, --buffer-size <buffer size>\n" +
+	"                           size of kernel buffer in MiB (def: 2MiB)\n" +
+	"  -y <link type>, --linktype <link type>\n" +
+	"                           link layer type (def: first appropriate)\n" +
+	"  --time-stamp-type <type> timestamp method for interface\n" +
+	"  -D, --list-interfaces    print list of interfaces and exit\n" +
+	"  -L, --list-data-link-types\n" +
+	"                           print list of link-layer types of iface and exit\n" +
+	"  --list-time-stamp-types  print list of timestamp types for iface and exit\n" +
+	"  -d                       print generated BPF code for capture filter\n" +
+	"  -S                       print statistics for each interface once per second\n" +
+	"  -M                       for -D, -L, and -S, produce machine-readable output\n" +
+	"\n" +
+	"Stop conditions:\n" +
+	"  -c <packet count>        stop after n packets (def: infinite)\n" +
+	"  -a <autostop cond.> ..., --autostop <autostop cond.> ...\n" +
+	"                           duration:NUM - stop after NUM seconds\n" +
+	"                           filesize:NUM - stop this file after NUM kB\n" +
+	"                              files:NUM - stop after NUM files\n" +
+	"                            packets:NUM - stop after NUM packets\n" +
+	"Output (files):\n" +
+	"  -w <filename>            name of file to save (def: tempfile)\n" +
+	"  -g                       enable group read access on the output file(s)\n" +
+	"  -b <ringbuffer opt.> ..., --ring-buffer <ringbuffer opt.>\n" +
+	"                           duration:NUM - switch to next file after NUM secs\n" +
+	"                           filesize:NUM - switch to next file after NUM kB\n" +
+	"                              files:NUM - ringbuffer: replace after NUM files\n" +
+	"                            packets:NUM - ringbuffer: replace after NUM packets\n" +
+	"                           interval:NUM - switch to next file when the time is\n" +
+	"                                          an exact multiple of NUM secs\n" +
+	"                          printname:FILE - print filename to FILE when written\n" +
+	"                                           (can use 'stdout' or 'stderr')\n" +
+	"  -n                       use pcapng format instead of pcap (default)\n" +
+	"  -P                       use libpcap format instead of pcapng\n" +
+	"  --capture-comment <comment>\n" +
+	"                           add a capture comment to the output file\n" +
+	"                           (only for pcapng)\n" +
+	"  --temp-dir <directory>   write temporary files to this directory\n" +
+	"                           (default: /tmp)\n" +
+	"\n" +
+	"Miscellaneous:\n" +
+	"  -N <packet_limit>        maximum number of packets buffered within dumpcap\n" +
+	"  -C <byte_limit>          maximum number of bytes used for buffering packets\n" +
+	"                           within dumpcap\n" +
+	"  -t                       use a separate thread per interface\n" +
+	"  -q                       don't report packet capture counts\n" +
+	"  -v, --version            print version information and exit\n" +
+	"  -h, --help               display this help and exit\n"
+
+// Excerpts of the help of dumpcap 1.12, which prints the first condition of
+// "-a" and "-b" on the line of the option
+const helpOutput112 = "Dumpcap 1.12.1 (Git Rev Unknown from unknown)\n" +
+	"Capture network packets and dump them into a pcapng or pcap file.\n" +
+	"See http://www.wireshark.org for more information.\n" +
+	"\n" +
+	"Usage: dumpcap [options] ...\n" +
+	"\n" +
+	"Capture interface:\n" +
+	"  -i <interface>           name or idx of interface (def: first non-loopback),\n" +
+	"                           or for remote capturing, use one of these formats:\n" +
+	"                               rpcap://<host>/<interface>\n" +
+	"                               TCP@<host>:<port>\n" +
+	"  -f <capture filter>      packet filter in libpcap filter syntax\n" +
+	"  -s <snaplen>             packet snapshot length (def: 65535)\n" +
+	"  -p                       don't capture in promiscuous mode\n" +
+	"  -D                       print list of interfaces and exit\n" +
+	"  -M                       for -D, -L, and -S, produce machine-readable output\n" +
+	"\n" +
+	"Stop conditions:\n" +
+	"  -c <packet count>        stop after n packets (def: infinite)\n" +
+	"  -a <autostop cond.> ...  duration:NUM - stop after NUM seconds\n" +
+	"                           filesize:NUM - stop this file after NUM KB\n" +
+	"                              files:NUM - stop after NUM files\n" +
+	"Output (files):\n" +
+	"  -w <filename>            name of file to save (def: tempfile)\n" +
+	"  -g                       enable group read access on the output file(s)\n" +
+	"  -b <ringbuffer opt.> ... duration:NUM - switch to next file after NUM secs\n" +
+	"                           filesize:NUM - switch to next file after NUM KB\n" +
+	"                              files:NUM - ringbuffer: replace after NUM files\n" +
+	"  -n                       use pcapng format instead of pcap (default)\n" +
+	"  -P                       use libpcap format instead of pcapng\n" +
+	"  --capture-comment <comment>\n" +
+	"                           add a capture comment to the output file\n" +
+	"                           (only for pcapng)\n" +
+	"\n" +
+	"Miscellaneous:\n" +
+	"  -t                       use a separate thread per interface\n" +
+	"  -q                       don't report packet capture counts\n" +
+	"  -v                       print version information and exit\n" +
+	"  -h                       display this help and exit\n"
+
+func TestParseHelpOld(t *testing.T) {
+	options := parseHelp(helpOutput112)
+	for _, o := range []string{"-i", "-a", "-a duration", "-a filesize", "-a files",
+		"-b", "-b duration", "-b filesize", "-b files", "-M", "--capture-comment"} {
+		if !options[o] {
+			t.Error(o)
+		}
+	}
+	for _, o := range []string{"-a packets", "-b interval", "-b packets", "-D duration",
+		"-L", "-S", "--interface"} {
+		if options[o] {
+			t.Error(o)
+		}
+	}
+
+	f := Features{options: options}
+	if err := f.Check(Arguments{StopOnDuration: 60, SwitchOnDuration: 1,
+		SwitchOnFiles: 3}); err != nil {
+		t.Error(err)
+	}
+	if err := f.Check(Arguments{StopOnPackets: 10}); err == nil {
+		t.Error("-a packets is not supported")
+	}
+}
+
+func TestParseHelp(t *testing.T) {
+	options := parseHelp(helpOutput)
+	for _, o := range []string{"-i", "--interface", "--ifname", "--ifdescr", "-p",
+		"--no-promiscuous-mode", "--time-stamp-type", "-d", "-a", "--autostop",
+		"-a packets", "-a files", "-b", "-b interval", "-b printname", "-b packets",
+		"--capture-comment", "--temp-dir", "-t", "-h"} {
+		if !options[o] {
+			t.Error(o)
+		}
+	}
+	for _, o := range []string{"-k", "-a interval", "-b nametimenum", "-i rpcap",
+		"<interface>", "--compress-type"} {
+		if options[o] {
+			t.Error(o)
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	d := newMockcap(mockRealVersionArg)
+	f, err := d.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version.String() != "3.6.2" || !f.Supports("--ifname") || f.Supports("-k") {
+		t.Error(f)
+	}
+	if f2, err := d.Features(); f2 != f || err != nil {
+		t.Error("features should be cached", f2, err)
+	}
+
+	if err = f.Check(Arguments{SwitchOnFiles: 2, SwitchOnDuration: 1,
+		DeviceArgs: []DeviceArgument{{Name: "em1"}}}); err != nil {
+		t.Error(err)
+	}
+	err = f.Check(Arguments{DeviceArgs: []DeviceArgument{{Name: "em1"},
+		{Name: "em2", WiFiChannel: "2412"}}})
+	if ue, ok := err.(*UnsupportedError); !ok || ue.Field != "DeviceArgs[1].WiFiChannel" ||
+		ue.Option != wifiChannelArg || ue.Version != "3.6.2" {
+		t.Error(err)
+	}
+	if err.Error() != "dumpcap 3.6.2 does not support -k required by DeviceArgs[1].WiFiChannel" {
+		t.Error(err)
+	}
+
+	if err = f.Check(Arguments{FileName: "foobar", SwitchOnInterval: time.Hour,
+		StopOnPackets: 10}); err != nil {
+		t.Error(err)
+	}
+	err = f.Check(Arguments{StopOnInterval: time.Hour})
+	if ue, ok := err.(*UnsupportedError); !ok || ue.Field != "StopOnInterval" ||
+		ue.Option != "-a interval" {
+		t.Error(err)
+	}
+
+	err = f.Check(Arguments{DeviceArgs: []DeviceArgument{{Name: "em1",
+		TimestampType: "adapter", NanosecondTimestamps: true}}})
+	if ue, ok := err.(*UnsupportedError); !ok || ue.Field != "DeviceArgs[0].NanosecondTimestamps" {
+		t.Error(err)
+	}
+
+	// NewCapture refuses unsupported arguments before dumpcap is started
+	if c, err := d.NewCapture(Arguments{WiFiChannel: "2412"}); c != nil || err == nil {
+		t.Error(c, err)
+	} else if ue, ok := err.(*UnsupportedError); !ok || ue.Field != "WiFiChannel" {
+		t.Error(err)
+	}
+}
+
+func TestFeaturesUnknown(t *testing.T) {
+	// Without knowing about any option, nothing is refused
+	f := Features{}
+	if err := f.Check(Arguments{WiFiChannel: "2412"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFeaturesFails(t *testing.T) {
+	d := newMockcap(mockFailExitArg)
+	if _, err := d.Features(); err != errFailExit {
+		t.Error(err)
+	}
+	if d.features.get() != nil {
+		t.Error("failed probes should not be cached")
+	}
+}
+
+func TestFeaturesConcurrent(t *testing.T) {
+	d := newMockcap(mockRealVersionArg)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := d.Features(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// Refused or not, depending on Features() having returned
+			if c, err := d.NewCapture(Arguments{WiFiChannel: "2412"}); err == nil {
+				c.Kill()
+				c.Close()
+				c.Wait()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package dumpcap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lukaslueg/dumpcap/bpf"
+)
+
+// BPFInstruction represents a single instruction of a compiled capture
+// filter, like a bpf.Statement.
+type BPFInstruction struct {
+	Opcode      string // e.g. "ldh" or "jeq"
+	Operand     string // e.g. "[12]" or "#0x800"; may be empty
+	Conditional bool   // True if the instruction is a conditional jump
+	JumpTrue    int    // The instruction to continue with if the condition is true
+	JumpFalse   int    // The instruction to continue with if the condition is false
+}
+
+// BPFProgram represents a capture filter compiled into BPF code by dumpcap.
+type BPFProgram struct {
+	Device       string // The device the filter was compiled for
+	LinkLayer    string // The link-layer type the filter was compiled for, if given
+	Filter       string // The capture filter
+	Instructions []BPFInstruction
+}
+
+// String returns the program in the same format dumpcap prints it.
+func (p BPFProgram) String() string {
+	var b strings.Builder
+	for i, ins := range p.Instructions {
+		if ins.Conditional {
+			fmt.Fprintf(&b, "(%03d) %-8s %-16s jt %d\tjf %d\n", i, ins.Opcode,
+				ins.Operand, ins.JumpTrue, ins.JumpFalse)
+		} else {
+			fmt.Fprintf(&b, "(%03d) %-8s %s\n", i, ins.Opcode, ins.Operand)
+		}
+	}
+	return b.String()
+}
+
+// Assemble converts the program into raw instructions which can be executed
+// by a bpf.VM.
+func (p BPFProgram) Assemble() ([]bpf.Instruction, error) {
+	stmts := make([]bpf.Statement, len(p.Instructions))
+	for i, ins := range p.Instructions {
+		stmts[i] = bpf.Statement(ins)
+	}
+	return bpf.Assemble(stmts)
+}
+
+// parseBPFProgram reads the BPF code printed by "dumpcap -d -Z". Lines which
+// do not contain an instruction are ignored.
+func parseBPFProgram(pipe io.Reader) (instructions []BPFInstruction, err error) {
+	scanner := bufio.NewScanner(pipe)
+	var offset int64
+	for scanner.Scan() {
+		line := scanner.Text()
+		illegal := &ProtocolError{Offset: offset, Raw: []byte(line)}
+		offset += int64(len(scanner.Bytes())) + 1
+		if !strings.HasPrefix(line, "(") {
+			continue
+		}
+		n, s, err := bpf.ParseStatement(line)
+		if err != nil || n != len(instructions) {
+			return nil, illegal
+		}
+		instructions = append(instructions, BPFInstruction(s))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(instructions) == 0 {
+		return nil, &ProtocolError{Offset: offset}
+	}
+	return instructions, nil
+}
+
+// CompileFilter makes a call to dumpcap to compile the given capture filter
+// for the given device and link-layer type into BPF code. The link-layer type
+// may be empty to use the device's default. Returns a *BadFilterError if the
+// filter is not valid.
+func (d *Dumpcap) CompileFilter(device, linkLayer, filter string) (*BPFProgram, error) {
+	return d.CompileFilterContext(context.Background(), device, linkLayer, filter)
+}
+
+// CompileFilterContext is like CompileFilter but kills dumpcap and returns
+// ctx.Err() if the given context is done before the filter was compiled.
+func (d *Dumpcap) CompileFilterContext(ctx context.Context, device, linkLayer, filter string) (*BPFProgram, error) {
+	args := Arguments{command: compileFilterCmd,
+		DeviceArgs: []DeviceArgument{{Name: device, LinkLayerType: linkLayer,
+			CaptureFilter: filter}}}
+
+	prog := &BPFProgram{Device: device, LinkLayer: linkLayer, Filter: filter}
+	err := d.runChild(ctx, args, func(stdout io.Reader) (err error) {
+		prog.Instructions, err = parseBPFProgram(stdout)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// CompileFilter is a convenience-function to execute CompileFilter() on a new Dumpcap-struct
+func CompileFilter(device, linkLayer, filter string) (*BPFProgram, error) {
+	return NewDumpcap().CompileFilter(device, linkLayer, filter)
+}
+
+// CompileFilterContext is a convenience-function to execute CompileFilterContext() on a new Dumpcap-struct
+func CompileFilterContext(ctx context.Context, device, linkLayer, filter string) (*BPFProgram, error) {
+	return NewDumpcap().CompileFilterContext(ctx, device, linkLayer, filter)
+}
@@ -0,0 +1,115 @@
+package dumpcap
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lukaslueg/dumpcap/bpf"
+)
+
+// The output of "dumpcap -d -f 'ip and udp port 53'" on an ethernet device
+const bpfOutput = "(000) ldh      [12]\n" +
+	"(001) jeq      #0x800           jt 2\tjf 12\n" +
+	"(002) ldb      [23]\n" +
+	"(003) jeq      #0x11            jt 4\tjf 12\n" +
+	"(004) ldh      [20]\n" +
+	"(005) jset     #0x1fff          jt 12\tjf 6\n" +
+	"(006) ldxb     4*([14]&0xf)\n" +
+	"(007) ldh      [x + 14]\n" +
+	"(008) jeq      #0x35            jt 11\tjf 9\n" +
+	"(009) ldh      [x + 16]\n" +
+	"(010) jeq      #0x35            jt 11\tjf 12\n" +
+	"(011) ret      #262144\n" +
+	"(012) ret      #0\n"
+
+func TestCompileFilter(t *testing.T) {
+	d := newMockcap()
+	prog, err := d.CompileFilter("em1", "EN10MB", "ip and udp port 53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Device != "em1" || prog.LinkLayer != "EN10MB" ||
+		prog.Filter != "ip and udp port 53" || len(prog.Instructions) != 13 {
+		t.Fatal(prog)
+	}
+	for i, expected := range map[int]BPFInstruction{
+		0:  {Opcode: "ldh", Operand: "[12]"},
+		1:  {Opcode: "jeq", Operand: "#0x800", Conditional: true, JumpTrue: 2, JumpFalse: 12},
+		6:  {Opcode: "ldxb", Operand: "4*([14]&0xf)"},
+		7:  {Opcode: "ldh", Operand: "[x + 14]"},
+		12: {Opcode: "ret", Operand: "#0"},
+	} {
+		if prog.Instructions[i] != expected {
+			t.Error(i, prog.Instructions[i])
+		}
+	}
+	if prog.String() != bpfOutput {
+		t.Error(prog)
+	}
+
+	raw, err := prog.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := bpf.NewVM(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An ethernet frame carrying a DNS query
+	packet := make([]byte, 42)
+	packet[12], packet[14], packet[23], packet[37] = 0x08, 0x45, 17, 53
+	if !vm.Matches(packet) {
+		t.Error(packet)
+	}
+	packet[37] = 54
+	if vm.Matches(packet) {
+		t.Error(packet)
+	}
+}
+
+func TestCompileFilterBadFilter(t *testing.T) {
+	d := newMockcap(mockFailFilterArg)
+	prog, err := d.CompileFilter("em1", "", "port foo")
+	var bfe *BadFilterError
+	if prog != nil || !errors.As(err, &bfe) || bfe.Interface != "em1" ||
+		bfe.Filter != "port foo" || bfe.Message != errText1 {
+		t.Error(prog, err)
+	}
+}
+
+func TestCompileFilterIllegalOutput(t *testing.T) {
+	d := newMockcap(mockIllegalOutputArg)
+	prog, err := d.CompileFilter("em1", "", "port 53")
+	var pe *ProtocolError
+	if prog != nil || !errors.As(err, &pe) {
+		t.Error(prog, err)
+	}
+
+	for _, output := range []string{
+		"(000) ldh      [12]\n(002) ret      #0\n",
+		"(000)\n",
+	} {
+		if _, err := parseBPFProgram(strings.NewReader(output)); !errors.As(err, &pe) {
+			t.Error(output, err)
+		}
+	}
+
+	// Lines other than instructions are skipped
+	ins, err := parseBPFProgram(strings.NewReader("em1:\n(000) ret      #262144\n"))
+	if err != nil || len(ins) != 1 || ins[0].Opcode != "ret" {
+		t.Error(ins, err)
+	}
+}
+
+func TestCompileFilterContext(t *testing.T) {
+	d := newMockcap(mockBlockArg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if prog, err := d.CompileFilterContext(ctx, "em1", "", "port 53"); prog != nil ||
+		err != context.DeadlineExceeded {
+		t.Error(prog, err)
+	}
+}
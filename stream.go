@@ -0,0 +1,198 @@
+package dumpcap
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/lukaslueg/dumpcap/capfile"
+)
+
+var errNoCaptureFile = errors.New("dumpcap reported packets before reporting a file")
+
+// StreamItem is delivered by a PacketStream for every packet read from the
+// files dumpcap writes and for every update about dropped packets.
+type StreamItem struct {
+	FileName  string          // The file the packet was read from
+	Packet    *capfile.Packet // The packet read; nil if the item reports dropped packets
+	DropCount uint64          // The absolute number of packets dropped as last reported by dumpcap
+}
+
+// PacketStream delivers the packets captured by dumpcap.
+type PacketStream struct {
+	Items    chan StreamItem
+	err      error
+	quit     chan int
+	quitOnce sync.Once
+	done     chan int
+}
+
+// Err returns the error which caused PacketStream.Items to be closed
+// prematurely. Err must only be called after PacketStream.Items was closed.
+func (ps *PacketStream) Err() error {
+	return ps.err
+}
+
+// Close stops the stream without waiting for dumpcap to quit and closes the
+// file being read. PacketStream.Items is closed once Close returns. The
+// capture keeps running; callers should Stop() or Kill() it. It is safe to
+// call Close more than once.
+func (ps *PacketStream) Close() {
+	ps.quitOnce.Do(func() { close(ps.quit) })
+	<-ps.done
+}
+
+// packetResult is a packet read from dumpcap's standard output, or the error
+// reading it.
+type packetResult struct {
+	packet *capfile.Packet
+	err    error
+}
+
+// readPackets reads packets until an error occurs, which is delivered as
+// well, or stop is closed.
+func readPackets(r *capfile.Reader, results chan<- packetResult, stop <-chan int) {
+	for {
+		p, err := r.Next()
+		select {
+		case results <- packetResult{packet: p, err: err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// send delivers an item; returns false if the stream was closed instead.
+func (ps *PacketStream) send(item StreamItem) bool {
+	select {
+	case ps.Items <- item:
+		return true
+	case <-ps.quit:
+		return false
+	}
+}
+
+// PacketStream reads the packets dumpcap writes and delivers them on
+// PacketStream.Items. The stream follows dumpcap from file to file as they
+// are reported by FileMsg, or their compressed successors if dumpcap was faster
+// than the stream, and reads exactly the number of packets reported by
+// each PacketCountMsg; DropCountMsg are delivered as items without a packet.
+// If the capture was started using StdoutFileName, packets are instead read
+// from Capture.Packets() as soon as dumpcap writes them, until it's end.
+// The stream consumes Capture.Messages, callers must not receive from it
+// themselves. PacketStream.Items is closed once dumpcap has quit, an error
+// occurred or the stream was closed; in the latter cases callers should Kill()
+// the capture.
+func (c Capture) PacketStream() *PacketStream {
+	ps := &PacketStream{Items: make(chan StreamItem), quit: make(chan int),
+		done: make(chan int)}
+
+	go func() {
+		defer close(ps.done)
+		defer close(ps.Items)
+
+		var r *capfile.Reader
+		var fname string
+		var dropCount uint64
+		var packets chan packetResult
+		if c.stdout != nil {
+			// Dumpcap blocks once the pipe is full, which is likely to
+			// happen long before it reports the packets written
+			r = capfile.NewReader(c.stdout)
+			fname = StdoutFileName
+			packets = make(chan packetResult)
+			stopReading := make(chan int)
+			defer close(stopReading)
+			go readPackets(r, packets, stopReading)
+		}
+		defer func() {
+			if r != nil && c.stdout == nil {
+				_ = r.Close()
+			}
+		}()
+
+		messages := c.Messages
+		for messages != nil || packets != nil {
+			var msg PipeMessage
+			var ok bool
+			select {
+			case res := <-packets:
+				if res.err == io.EOF {
+					packets = nil
+				} else if res.err != nil {
+					ps.err = res.err
+					return
+				} else if !ps.send(StreamItem{FileName: fname, Packet: res.packet, DropCount: dropCount}) {
+					return
+				}
+				continue
+			case msg, ok = <-messages:
+			case <-ps.quit:
+				return
+			}
+			if !ok {
+				messages = nil
+				continue
+			}
+			switch msg.Type {
+			case FileMsg:
+				if c.stdout != nil {
+					continue
+				}
+				if r != nil {
+					_ = r.Close()
+					r = nil
+				}
+				fname = msg.Text
+				f, err := capfile.Open(fname)
+				if os.IsNotExist(err) && msg.FinalFileName != "" && msg.FinalFileName != fname {
+					// Dumpcap has already compressed the file
+					fname = msg.FinalFileName
+					f, err = capfile.Open(fname)
+				}
+				if err != nil {
+					ps.err = err
+					return
+				}
+				r = f
+			case PacketCountMsg:
+				if c.stdout != nil {
+					continue
+				}
+				if r == nil {
+					ps.err = errNoCaptureFile
+					return
+				}
+				for i := uint64(0); i < msg.PacketCount; i++ {
+					p, err := r.Next()
+					if err != nil {
+						// Dumpcap has flushed all packets it reports on,
+						// the file is truncated.
+						if err == io.EOF {
+							err = io.ErrUnexpectedEOF
+						}
+						ps.err = err
+						return
+					}
+					if !ps.send(StreamItem{FileName: fname, Packet: p, DropCount: dropCount}) {
+						return
+					}
+				}
+			case DropCountMsg:
+				dropCount = msg.DropCount
+				if !ps.send(StreamItem{FileName: fname, DropCount: dropCount}) {
+					return
+				}
+			case ErrMsg, BadFilterMsg:
+				ps.err = msg.Err()
+				return
+			}
+		}
+	}()
+
+	return ps
+}
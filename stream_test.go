@@ -0,0 +1,206 @@
+package dumpcap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pcapFile generates a PCAP file containing the given number of packets.
+func pcapFile(packets int) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{0xa1b2c3d4, 0x00040002, 0, 0, 65535, 1})
+	for i := 0; i < packets; i++ {
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(i), 0, 4, 4})
+		binary.Write(&b, binary.LittleEndian, uint32(i))
+	}
+	return b.Bytes()
+}
+
+func TestPacketStream(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(fname, pcapFile(123), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: fname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := c.PacketStream()
+	var packets uint32
+	var drops int
+	for item := range ps.Items {
+		if item.FileName != fname {
+			t.Error(item.FileName)
+		}
+		if item.Packet == nil {
+			drops++
+			if item.DropCount != 456 {
+				t.Error(item.DropCount)
+			}
+			continue
+		}
+		if binary.LittleEndian.Uint32(item.Packet.Data) != packets {
+			t.Error(item.Packet)
+		}
+		packets++
+	}
+	if packets != 123 || drops != 1 {
+		t.Error(packets, drops)
+	}
+	if err = ps.Err(); err != nil {
+		t.Error(err)
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPacketStreamCompressed(t *testing.T) {
+	// Only the compressed file is left
+	fname := filepath.Join(t.TempDir(), "capture.pcap")
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(pcapFile(123))
+	w.Close()
+	if err := os.WriteFile(fname+gzipSuffix, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: fname, SwitchOnFilesize: 1000,
+		Compression: UseGzipCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := c.PacketStream()
+	var packets int
+	for item := range ps.Items {
+		if item.FileName != fname+gzipSuffix {
+			t.Error(item.FileName)
+		}
+		if item.Packet != nil {
+			packets++
+		}
+	}
+	if packets != 123 {
+		t.Error(packets)
+	}
+	if err = ps.Err(); err != nil {
+		t.Error(err)
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPacketStreamTruncated(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(fname, pcapFile(100), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: fname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := c.PacketStream()
+	for range ps.Items {
+	}
+	if err = ps.Err(); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+	c.Kill()
+	c.Close()
+}
+
+func TestPacketStreamStdout(t *testing.T) {
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: StdoutFileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := c.PacketStream()
+	var packets int
+	for item := range ps.Items {
+		if item.FileName != StdoutFileName {
+			t.Error(item.FileName)
+		}
+		if item.Packet != nil {
+			packets++
+		}
+	}
+	if packets != 123 {
+		t.Error(packets)
+	}
+	if err = ps.Err(); err != nil {
+		t.Error(err)
+	}
+	if err = c.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPacketStreamBadFilter(t *testing.T) {
+	d := newMockcap(mockFailFilterArg)
+	c, err := d.NewCapture(Arguments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := c.PacketStream()
+	for range ps.Items {
+	}
+	var bfe *BadFilterError
+	if err = ps.Err(); !errors.As(err, &bfe) || bfe.Message != errText1 {
+		t.Error(err)
+	}
+}
+
+func TestPacketStreamClose(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(fname, pcapFile(123), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream stops while delivering packets nobody receives
+	d := newMockcap()
+	c, err := d.NewCapture(Arguments{FileName: fname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := c.PacketStream()
+	if item := <-ps.Items; item.Packet == nil {
+		t.Error(item)
+	}
+	ps.Close()
+	if _, ok := <-ps.Items; ok {
+		t.Error("the stream should be closed")
+	}
+	ps.Close()
+	c.Kill()
+	c.Close()
+
+	// The stream stops while waiting for dumpcap to report packets
+	d = newMockcap(mockBlockArg)
+	if c, err = d.NewCapture(Arguments{FileName: fname}); err != nil {
+		t.Fatal(err)
+	}
+	ps = c.PacketStream()
+	ps.Close()
+	if _, ok := <-ps.Items; ok {
+		t.Error("the stream should be closed")
+	}
+	if err = ps.Err(); err != nil {
+		t.Error(err)
+	}
+	c.Kill()
+	c.Close()
+}
@@ -0,0 +1,273 @@
+/* Dumpcap interface for golang
+Copyright (C) 2014 Lukas Lueg, lukas.lueg@gmail.com
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the GNU General Public License as published by the Free Software
+Foundation; either version 3 of the License, or (at your option) any later
+version.
+This program is distributed in the hope that it will be useful, but WITHOUT ANY
+WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+You should have received a copy of the GNU General Public License along with
+this program; if not, write to the Free Software Foundation, Inc., 51 Franklin
+Street, Fifth Floor, Boston, MA 02110-1301  USA
+*/
+
+/*
+Package syncpipe reads and writes the messages dumpcap exchanges with it's
+parent process when started with "-Z", the so called sync-pipe protocol.
+Each message consists of a four byte header, one byte for the type of message
+and three for the size of the following payload, which is usually a
+NUL-terminated string. While older versions of dumpcap limited payloads to
+4096 bytes, newer ones send considerably larger messages, e.g. lists of
+interfaces; all sizes the header can express are supported.
+Messages of unknown type, e.g. sent by versions of dumpcap newer than this
+package, are decoded without interpretation instead of causing an error.
+Like all known types, the type of such a message has to be an uppercase ASCII
+letter though; anything else is taken for input which is not a sync-pipe.
+This allows to build test doubles, proxies and recorders which speak the
+protocol exactly as dumpcap does.
+*/
+package syncpipe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The message types. Taken from sync_pipe.h and hopefully not subject to
+// change
+const (
+	BadFilterMsg      byte = 'B' // At least one of the given capture filters is invalid.
+	DropCountMsg      byte = 'D' // The absolute number of packets dropped.
+	ErrMsg            byte = 'E' // A general error, consisting of a primary and a secondary message.
+	FileMsg           byte = 'F' // Dumpcap has started to write captured traffic to a new file.
+	InterfaceListMsg  byte = 'I' // A list of interfaces or their capabilities.
+	PacketCountMsg    byte = 'P' // The number of packets written to the currently active file.
+	QuitMsg           byte = 'Q' // Sent by the parent to ask dumpcap to stop capturing.
+	SuccessMsg        byte = 'S' // Dumpcap reports successful execution.
+	ToolbarControlMsg byte = 'T' // A control packet for an extcap interface toolbar, not NUL-terminated.
+)
+
+// HeaderSize is the size of a message's header.
+const HeaderSize = 4
+
+// MaxPayloadSize is the largest payload a message may carry.
+const MaxPayloadSize = 1<<24 - 1
+
+// ErrTooLarge is returned by the Writer if a payload exceeds MaxPayloadSize.
+var ErrTooLarge = errors.New("syncpipe: payload too large")
+
+// ErrInvalidHeader is returned if a message's type is not an uppercase ASCII
+// letter.
+var ErrInvalidHeader = errors.New("syncpipe: invalid message header")
+
+// Message represents a decoded message.
+type Message struct {
+	Type           byte   // One of BadFilterMsg, ErrMsg, etc.
+	Text           string // The text of BadFilterMsg, FileMsg, InterfaceListMsg, QuitMsg and SuccessMsg; for FileMsg the filename.
+	Primary        string // The primary part of an ErrMsg.
+	Secondary      string // The secondary part of an ErrMsg, may be empty.
+	InterfaceIndex int    // The index of the interface a BadFilterMsg refers to, -1 if not given.
+	Count          uint64 // The number of packets of DropCountMsg and PacketCountMsg.
+	Raw            []byte // The undecoded payload; for messages of unknown type the only content.
+}
+
+// Known returns true if the message is of one of the types known to this
+// package.
+func (m Message) Known() bool {
+	return knownType(m.Type)
+}
+
+// knownType returns true if msgType is one of the known message types.
+func knownType(msgType byte) bool {
+	switch msgType {
+	case BadFilterMsg, DropCountMsg, ErrMsg, FileMsg, InterfaceListMsg,
+		PacketCountMsg, QuitMsg, SuccessMsg, ToolbarControlMsg:
+		return true
+	}
+	return false
+}
+
+// validType returns true if msgType might be a message type at all.
+func validType(msgType byte) bool {
+	return msgType >= 'A' && msgType <= 'Z'
+}
+
+// Reader decodes messages from an input stream. A Reader does not read ahead,
+// the input may be used otherwise between calls.
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader returns a Reader which decodes messages from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadFrame reads a single message of any type without decoding it's
+// payload. Returns io.EOF if the input ends before a message starts,
+// io.ErrUnexpectedEOF if it ends within a message and ErrInvalidHeader,
+// without reading further, if the header is implausible.
+func (r *Reader) ReadFrame() (msgType byte, payload []byte, err error) {
+	header := make([]byte, HeaderSize)
+	if _, err = io.ReadFull(r.r, header); err != nil {
+		return 0, nil, err
+	}
+	msgType = header[0]
+	if !validType(msgType) {
+		return 0, nil, fmt.Errorf("%w: %q", ErrInvalidHeader, header)
+	}
+	size := (int64(header[1]) << 16) | (int64(header[2]) << 8) | (int64(header[3]) << 0)
+	if size == 0 {
+		return msgType, nil, nil
+	}
+	// The buffer grows as the payload arrives instead of trusting the
+	// header, which might be garbage
+	var buf bytes.Buffer
+	if _, err = io.CopyN(&buf, r.r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return msgType, buf.Bytes(), nil
+}
+
+// decodeString returns a payload's text, without the terminating NUL.
+func decodeString(payload []byte) string {
+	return strings.TrimSuffix(string(payload), "\x00")
+}
+
+// ReadMessage reads and decodes a single message. Messages of unknown type
+// are returned with only Type and Raw filled.
+func (r *Reader) ReadMessage() (*Message, error) {
+	msgType, payload, err := r.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return decode(msgType, payload)
+}
+
+// decode converts a message's payload according to it's type.
+func decode(msgType byte, payload []byte) (*Message, error) {
+	msg := &Message{Type: msgType, InterfaceIndex: -1, Raw: payload}
+	if !knownType(msgType) {
+		return msg, nil
+	}
+	text := decodeString(payload)
+	switch msgType {
+	case DropCountMsg, PacketCountMsg:
+		count, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("syncpipe: illegal count in message %q: %w", msgType, err)
+		}
+		msg.Count = count
+	case ErrMsg:
+		// The payload consists of two more messages carrying the primary
+		// and secondary text
+		inner := NewReader(bytes.NewReader(payload))
+		for _, p := range []*string{&msg.Primary, &msg.Secondary} {
+			_, part, err := inner.ReadFrame()
+			if err != nil {
+				return nil, fmt.Errorf("syncpipe: illegal error message: %w", err)
+			}
+			*p = decodeString(part)
+		}
+	case BadFilterMsg:
+		// The text is prefixed by the index of the interface, as in
+		// "1:syntax error"
+		msg.Text = text
+		if i := strings.Index(text, ":"); i > 0 {
+			if n, err := strconv.ParseUint(text[:i], 10, 0); err == nil {
+				msg.InterfaceIndex = int(n)
+				msg.Text = text[i+1:]
+			}
+		}
+	case ToolbarControlMsg:
+		// The payload is binary and only available as Raw
+	default:
+		msg.Text = text
+	}
+	return msg, nil
+}
+
+// Writer encodes messages to an output stream.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a Writer which encodes messages to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// frame returns the encoded message of the given type and payload.
+func frame(msgType byte, payload []byte) ([]byte, error) {
+	if !validType(msgType) {
+		return nil, ErrInvalidHeader
+	}
+	if len(payload) > MaxPayloadSize {
+		return nil, ErrTooLarge
+	}
+	size := len(payload)
+	b := make([]byte, 0, HeaderSize+size)
+	b = append(b, msgType, byte(size>>16), byte(size>>8), byte(size))
+	return append(b, payload...), nil
+}
+
+// encodeString returns the payload carrying the given text; like dumpcap does,
+// the text is NUL-terminated.
+func encodeString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// WriteFrame writes a single message of the given type and payload, which is
+// written as is.
+func (w *Writer) WriteFrame(msgType byte, payload []byte) error {
+	b, err := frame(msgType, payload)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(b)
+	return err
+}
+
+// WriteMessage encodes the given message the same way dumpcap does. Messages
+// of known type are encoded from their fields, except for ToolbarControlMsg;
+// for all other messages Raw is written as is. Each message is written using
+// a single call to the underlying io.Writer.
+func (w *Writer) WriteMessage(msg *Message) error {
+	var payload []byte
+	switch msg.Type {
+	case DropCountMsg, PacketCountMsg:
+		payload = encodeString(strconv.FormatUint(msg.Count, 10))
+	case ErrMsg:
+		primary, err := frame(ErrMsg, encodeString(msg.Primary))
+		if err != nil {
+			return err
+		}
+		secondary, err := frame(ErrMsg, encodeString(msg.Secondary))
+		if err != nil {
+			return err
+		}
+		payload = append(primary, secondary...)
+	case BadFilterMsg:
+		text := msg.Text
+		if msg.InterfaceIndex >= 0 {
+			text = strconv.Itoa(msg.InterfaceIndex) + ":" + text
+		}
+		payload = encodeString(text)
+	case FileMsg, InterfaceListMsg, QuitMsg, SuccessMsg:
+		if msg.Text != "" {
+			payload = encodeString(msg.Text)
+		}
+	default:
+		payload = msg.Raw
+	}
+	return w.WriteFrame(msg.Type, payload)
+}
@@ -0,0 +1,172 @@
+package syncpipe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundtrip(t *testing.T) {
+	messages := []Message{
+		{Type: BadFilterMsg, Text: "syntax error", InterfaceIndex: 2},
+		{Type: BadFilterMsg, Text: "syntax error", InterfaceIndex: -1},
+		{Type: DropCountMsg, Count: 456, InterfaceIndex: -1},
+		{Type: ErrMsg, Primary: "Not so much", Secondary: "Something is wrong", InterfaceIndex: -1},
+		{Type: ErrMsg, Primary: "Not so much", InterfaceIndex: -1},
+		{Type: FileMsg, Text: "/tmp/foo.pcapng", InterfaceIndex: -1},
+		{Type: InterfaceListMsg, Text: `[{"name":"eth0"}]`, InterfaceIndex: -1},
+		{Type: PacketCountMsg, Count: 123, InterfaceIndex: -1},
+		{Type: QuitMsg, InterfaceIndex: -1},
+		{Type: SuccessMsg, InterfaceIndex: -1},
+		{Type: SuccessMsg, Text: "This is a huge success", InterfaceIndex: -1},
+	}
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	for i := range messages {
+		if err := w.WriteMessage(&messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(&b)
+	for _, expected := range messages {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Raw = nil
+		if !reflect.DeepEqual(*msg, expected) {
+			t.Error(msg, expected)
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Error(err)
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	for _, c := range []struct {
+		msg      Message
+		expected string
+	}{
+		{Message{Type: SuccessMsg}, "S\x00\x00\x00"},
+		{Message{Type: PacketCountMsg, Count: 123}, "P\x00\x00\x04123\x00"},
+		{Message{Type: BadFilterMsg, Text: "foo"}, "B\x00\x00\x060:foo\x00"},
+		{Message{Type: ErrMsg, Primary: "a", Secondary: "b"},
+			"E\x00\x00\x0cE\x00\x00\x02a\x00E\x00\x00\x02b\x00"},
+	} {
+		var b bytes.Buffer
+		if err := NewWriter(&b).WriteMessage(&c.msg); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Errorf("%q", b.String())
+		}
+	}
+}
+
+func TestReadFails(t *testing.T) {
+	for input, expected := range map[string]error{
+		"S\x00":                      io.ErrUnexpectedEOF,
+		"F\x00\x00\x05foo":           io.ErrUnexpectedEOF,
+		"E\x00\x00\x04E\x00\x00\x01": io.ErrUnexpectedEOF,
+	} {
+		if _, err := NewReader(strings.NewReader(input)).ReadMessage(); !errors.Is(err, expected) {
+			t.Errorf("%q: %v", input, err)
+		}
+	}
+	if _, err := NewReader(strings.NewReader("P\x00\x00\x04foo\x00")).ReadMessage(); err == nil {
+		t.Error("illegal count should fail")
+	}
+}
+
+func TestReadGibberish(t *testing.T) {
+	// Gibberish is rejected right after it's header, the rest of the input
+	// is never read
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("foobar\n"))
+	done := make(chan error)
+	go func() {
+		_, err := NewReader(pr).ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrInvalidHeader) {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reading gibberish should fail immediately")
+	}
+
+	for _, input := range []string{"\x00\x00\x00\x00", "s\x00\x00\x00", "\xff\x00\x00\x01x"} {
+		if _, err := NewReader(strings.NewReader(input)).ReadMessage(); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%q: %v", input, err)
+		}
+	}
+}
+
+func TestWriteFails(t *testing.T) {
+	w := NewWriter(io.Discard)
+	if err := w.WriteFrame(FileMsg, make([]byte, MaxPayloadSize+1)); err != ErrTooLarge {
+		t.Error(err)
+	}
+	if err := w.WriteFrame('x', nil); err != ErrInvalidHeader {
+		t.Error(err)
+	}
+}
+
+func TestUnknownType(t *testing.T) {
+	input := "X\x00\x00\x03\x01\x02\x03S\x00\x00\x00"
+	r := NewReader(strings.NewReader(input))
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != 'X' || msg.Known() || !bytes.Equal(msg.Raw, []byte{1, 2, 3}) {
+		t.Error(msg)
+	}
+	// The stream continues after a message of unknown type
+	if msg, err := r.ReadMessage(); err != nil || msg.Type != SuccessMsg || !msg.Known() {
+		t.Error(msg, err)
+	}
+
+	// Unknown messages are forwarded unchanged
+	var b bytes.Buffer
+	if err := NewWriter(&b).WriteMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != input[:7] {
+		t.Errorf("%q", b.String())
+	}
+}
+
+func TestToolbarControl(t *testing.T) {
+	var b bytes.Buffer
+	ctrl := []byte{'T', 0, 0, 2, 1, 0}
+	if err := NewWriter(&b).WriteMessage(&Message{Type: ToolbarControlMsg, Raw: ctrl}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewReader(&b).ReadMessage()
+	if err != nil || msg.Type != ToolbarControlMsg || msg.Text != "" || !bytes.Equal(msg.Raw, ctrl) {
+		t.Error(msg, err)
+	}
+}
+
+func TestLargeMessage(t *testing.T) {
+	// Larger than the 4096 bytes older versions of dumpcap allowed
+	text := strings.Repeat("x", 1<<20)
+	var b bytes.Buffer
+	if err := NewWriter(&b).WriteMessage(&Message{Type: InterfaceListMsg, Text: text}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewReader(&b).ReadMessage()
+	if err != nil || msg.Text != text {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,411 @@
+package dumpcap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunk is a piece of output read from dumpcap.
+type Chunk struct {
+	At   time.Duration // The time the chunk was read, relative to dumpcap's start
+	Data []byte
+}
+
+// Session is the record of a single call to dumpcap.
+type Session struct {
+	Args        []string      // The arguments dumpcap was called with, without the executable and nsenter
+	Stdout      []Chunk       // The output read from dumpcap's standard output
+	Stderr      []Chunk       // The output read from dumpcap's standard error, usually sync-pipe messages
+	StartError  string        // The error starting dumpcap, if it could not be started
+	ExitCode    int           // The exit status; -1 if dumpcap was killed
+	ExitStderr  string        // The output to standard error reported along with a non-zero exit status
+	WaitError   string        // An error other than a non-zero exit status reported when dumpcap exited
+	Interrupted time.Duration // The time dumpcap was first sent a signal other than os.Kill, relative to it's start; zero if never
+	Duration    time.Duration // The time dumpcap ran for
+}
+
+// Transcript is the record of all calls made to dumpcap, in order. A
+// transcript is saved as JSON; transcripts collected using different versions
+// of dumpcap allow to regression-test the parsing of dumpcap's output without
+// having those versions installed.
+type Transcript struct {
+	Sessions []*Session
+}
+
+// LoadTranscript reads a transcript from the given file.
+func LoadTranscript(name string) (*Transcript, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transcript{}
+	if err = json.Unmarshal(buf, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Save writes the transcript to the given file.
+func (t *Transcript) Save(name string) error {
+	buf, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, buf, 0644)
+}
+
+// Recorder records all calls a Dumpcap makes into a Transcript.
+type Recorder struct {
+	mu         sync.Mutex
+	transcript Transcript
+	newCommand Runner
+}
+
+// NewRecorder makes the given Dumpcap record all further calls to dumpcap.
+// Dumpcap still runs as usual; what it outputs is recorded as it is read.
+func NewRecorder(d *Dumpcap) *Recorder {
+	r := &Recorder{newCommand: d.newCommand}
+	d.newCommand = r.command
+	return r
+}
+
+// Transcript returns a copy of everything recorded so far.
+func (r *Recorder) Transcript() *Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &Transcript{}
+	for _, s := range r.transcript.Sessions {
+		c := *s
+		c.Args = append([]string(nil), s.Args...)
+		c.Stdout = append([]Chunk(nil), s.Stdout...)
+		c.Stderr = append([]Chunk(nil), s.Stderr...)
+		t.Sessions = append(t.Sessions, &c)
+	}
+	return t
+}
+
+func (r *Recorder) command(name string, arg ...string) Commander {
+	s := &Session{Args: append([]string(nil), dumpcapArgs(name, arg)...)}
+	r.mu.Lock()
+	r.transcript.Sessions = append(r.transcript.Sessions, s)
+	r.mu.Unlock()
+	return &recordingCommand{Commander: r.newCommand(name, arg...),
+		recorder: r, session: s, start: time.Now()}
+}
+
+// recordingCommand wraps a Commander, recording what it does.
+type recordingCommand struct {
+	Commander
+	recorder *Recorder
+	session  *Session
+	start    time.Time
+}
+
+// recordingReader records everything read from a pipe.
+type recordingReader struct {
+	io.ReadCloser
+	cmd    *recordingCommand
+	chunks *[]Chunk
+}
+
+func (rr recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.ReadCloser.Read(p)
+	if n > 0 {
+		rr.cmd.record(func(s *Session) {
+			*rr.chunks = append(*rr.chunks, Chunk{At: time.Since(rr.cmd.start),
+				Data: append([]byte(nil), p[:n]...)})
+		})
+	}
+	return n, err
+}
+
+// record modifies the session while holding the recorder's lock.
+func (c *recordingCommand) record(f func(s *Session)) {
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	f(c.session)
+}
+
+// recordExit records the result of dumpcap exiting.
+func (c *recordingCommand) recordExit(err error) {
+	c.record(func(s *Session) {
+		s.Duration = time.Since(c.start)
+		var ee *ExitError
+		if errors.As(err, &ee) {
+			s.ExitCode = ee.Code
+			s.ExitStderr = ee.Stderr
+		} else if err != nil {
+			s.WaitError = err.Error()
+		}
+	})
+}
+
+func (c *recordingCommand) Start() error {
+	c.start = time.Now()
+	err := c.Commander.Start()
+	if err != nil {
+		c.record(func(s *Session) { s.StartError = err.Error() })
+	}
+	return err
+}
+
+func (c *recordingCommand) Run() error {
+	c.start = time.Now()
+	err := c.Commander.Run()
+	c.recordExit(err)
+	return err
+}
+
+func (c *recordingCommand) StdoutPipe() (io.ReadCloser, error) {
+	rc, err := c.Commander.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return recordingReader{ReadCloser: rc, cmd: c, chunks: &c.session.Stdout}, nil
+}
+
+func (c *recordingCommand) StderrPipe() (io.ReadCloser, error) {
+	rc, err := c.Commander.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	return recordingReader{ReadCloser: rc, cmd: c, chunks: &c.session.Stderr}, nil
+}
+
+func (c *recordingCommand) Wait() error {
+	err := c.Commander.Wait()
+	c.recordExit(err)
+	return err
+}
+
+func (c *recordingCommand) Output() ([]byte, error) {
+	c.start = time.Now()
+	buf, err := c.Commander.Output()
+	c.record(func(s *Session) {
+		if len(buf) > 0 {
+			s.Stdout = append(s.Stdout, Chunk{At: time.Since(c.start), Data: buf})
+		}
+	})
+	c.recordExit(err)
+	return buf, err
+}
+
+func (c *recordingCommand) Signal(sig os.Signal) error {
+	if sig != os.Kill {
+		c.record(func(s *Session) {
+			if s.Interrupted == 0 {
+				s.Interrupted = time.Since(c.start)
+			}
+		})
+	}
+	return c.Commander.Signal(sig)
+}
+
+// Replayer plays back a Transcript instead of calling dumpcap. Each call is
+// answered by the next Session of the transcript, which must have been
+// recorded using the same arguments. Output is delivered as fast as it is
+// read; output recorded after dumpcap was asked to stop is held back until
+// it is asked to stop again.
+type Replayer struct {
+	mu         sync.Mutex
+	transcript *Transcript
+	next       int
+}
+
+// NewReplayer returns a Replayer for the given transcript.
+func NewReplayer(t *Transcript) *Replayer {
+	return &Replayer{transcript: t}
+}
+
+// Dumpcap returns a Dumpcap which calls the Replayer instead of dumpcap.
+func (r *Replayer) Dumpcap() *Dumpcap {
+	return NewDumpcapWithRunner(r.Command)
+}
+
+// Remaining returns the number of sessions which have not been replayed yet.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.transcript.Sessions) - r.next
+}
+
+// Command is a Runner which returns a Commander replaying the next session of
+// the transcript. If the arguments do not match, the Commander fails to
+// start. Dumpcap is never actually called via nsenter, the network namespace
+// is ignored.
+func (r *Replayer) Command(name string, arg ...string) Commander {
+	arg = dumpcapArgs(name, arg)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := &replayCommand{interrupted: make(chan int), killed: make(chan int),
+		done: make(chan int)}
+	if r.next >= len(r.transcript.Sessions) {
+		c.err = fmt.Errorf("replay: unexpected call to dumpcap %s, transcript exhausted",
+			strings.Join(arg, " "))
+		return c
+	}
+	s := r.transcript.Sessions[r.next]
+	if strings.Join(s.Args, "\x00") != strings.Join(arg, "\x00") {
+		c.err = fmt.Errorf("replay: expected call to dumpcap %s, got dumpcap %s",
+			strings.Join(s.Args, " "), strings.Join(arg, " "))
+		return c
+	}
+	r.next++
+	c.session = s
+	return c
+}
+
+// replayCommand implements the Commander interface by replaying a Session.
+type replayCommand struct {
+	session         *Session
+	err             error // the transcript does not match the call
+	stdout          *replayPipe
+	stderr          *replayPipe
+	writers         sync.WaitGroup
+	interrupted     chan int
+	interruptedOnce sync.Once
+	killed          chan int
+	killedOnce      sync.Once
+	done            chan int
+}
+
+// replayPipe delivers recorded output.
+type replayPipe struct {
+	*io.PipeReader
+	w *io.PipeWriter
+}
+
+// Read behaves like reading from an *os.File: Reading from a pipe closed by
+// the reader returns an *os.PathError.
+func (p replayPipe) Read(b []byte) (int, error) {
+	n, err := p.PipeReader.Read(b)
+	if err == io.ErrClosedPipe {
+		err = &os.PathError{Op: "read", Path: "|0", Err: os.ErrClosed}
+	}
+	return n, err
+}
+
+// pipe returns a pipe recorded output is written to once started.
+func (c *replayCommand) pipe(p **replayPipe) (io.ReadCloser, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	r, w := io.Pipe()
+	*p = &replayPipe{PipeReader: r, w: w}
+	return *p, nil
+}
+
+func (c *replayCommand) StdoutPipe() (io.ReadCloser, error) {
+	return c.pipe(&c.stdout)
+}
+
+func (c *replayCommand) StderrPipe() (io.ReadCloser, error) {
+	return c.pipe(&c.stderr)
+}
+
+// replay writes the given chunks to the given pipe.
+func (c *replayCommand) replay(p *replayPipe, chunks []Chunk) {
+	defer c.writers.Done()
+	defer p.w.Close()
+	for _, chunk := range chunks {
+		if c.session.Interrupted != 0 && chunk.At > c.session.Interrupted {
+			select {
+			case <-c.interrupted:
+			case <-c.killed:
+				return
+			}
+		}
+		if _, err := p.w.Write(chunk.Data); err != nil {
+			return
+		}
+	}
+}
+
+func (c *replayCommand) Start() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.session.StartError != "" {
+		return errors.New(c.session.StartError)
+	}
+	if c.stdout != nil {
+		c.writers.Add(1)
+		go c.replay(c.stdout, c.session.Stdout)
+	}
+	if c.stderr != nil {
+		c.writers.Add(1)
+		go c.replay(c.stderr, c.session.Stderr)
+	}
+	go func() {
+		c.writers.Wait()
+		close(c.done)
+	}()
+	return nil
+}
+
+// exitError returns the error recorded for dumpcap's exit.
+func (c *replayCommand) exitError() error {
+	if c.session.WaitError != "" {
+		return errors.New(c.session.WaitError)
+	}
+	if c.session.ExitCode != 0 {
+		return &ExitError{Code: c.session.ExitCode, Stderr: c.session.ExitStderr}
+	}
+	return nil
+}
+
+func (c *replayCommand) Wait() error {
+	select {
+	case <-c.done:
+	case <-c.killed:
+		return &ExitError{Code: -1}
+	}
+	return c.exitError()
+}
+
+func (c *replayCommand) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+func (c *replayCommand) Output() ([]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.session.StartError != "" {
+		return nil, errors.New(c.session.StartError)
+	}
+	var buf []byte
+	for _, chunk := range c.session.Stdout {
+		buf = append(buf, chunk.Data...)
+	}
+	return buf, c.exitError()
+}
+
+// Signal kills the replayed dumpcap if sig is os.Kill; all other signals ask
+// it to stop.
+func (c *replayCommand) Signal(sig os.Signal) error {
+	if sig != os.Kill {
+		c.interruptedOnce.Do(func() { close(c.interrupted) })
+		return nil
+	}
+	c.killedOnce.Do(func() {
+		close(c.killed)
+		// Like the pipes of a process which died, output not read yet is
+		// lost
+		for _, p := range []*replayPipe{c.stdout, c.stderr} {
+			if p != nil {
+				p.w.Close()
+			}
+		}
+	})
+	return nil
+}
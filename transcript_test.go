@@ -0,0 +1,301 @@
+package dumpcap
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var recordGolden = flag.String("record-golden", "",
+	"record a golden transcript using the installed dumpcap to the given file in testdata")
+
+// goldenFileName is the file the capture of a golden session is written to,
+// relative to the package's directory.
+const goldenFileName = "golden.pcapng"
+
+// golden is what a golden session finds out using dumpcap.
+type golden struct {
+	version  *VersionInfo
+	devices  []Device
+	device   Device // The first device, including it's capabilities
+	stats    []DeviceStatistics
+	messages []PipeMessage
+}
+
+// goldenSession calls dumpcap the way the transcripts in testdata were
+// recorded: The first device listed is queried for it's capabilities, one
+// round of statistics is read and traffic is captured for a second.
+func goldenSession(t *testing.T, d *Dumpcap) golden {
+	var g golden
+	var err error
+	if g.version, err = d.VersionInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if g.devices, err = d.Devices(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.devices) == 0 {
+		t.Fatal("there should be devices")
+	}
+	g.device = g.devices[0]
+	if err = d.Capabilities(&g.device, false); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := d.NewStatistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range g.devices {
+		ds, ok := <-stats.Stats
+		if !ok {
+			t.Fatal("there should be statistics for every device")
+		}
+		g.stats = append(g.stats, ds)
+	}
+	go func() {
+		for range stats.Stats {
+		}
+	}()
+	if err = stats.Stop(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := d.NewCapture(Arguments{FileName: goldenFileName, StopOnDuration: 1,
+		DeviceArgs: []DeviceArgument{{Name: g.device.Name}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for msg := range c.Messages {
+		g.messages = append(g.messages, msg)
+	}
+	if err = c.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestRecordGolden(t *testing.T) {
+	if *recordGolden == "" {
+		t.Skip("use -record-golden to record a transcript")
+	}
+	d := NewDumpcap()
+	r := NewRecorder(d)
+	goldenSession(t, d)
+	os.Remove(goldenFileName)
+	if err := r.Transcript().Save(filepath.Join("testdata", *recordGolden)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoldenTranscripts(t *testing.T) {
+	names, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatal("there should be golden transcripts")
+	}
+	for _, name := range names {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			transcript, err := LoadTranscript(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := NewReplayer(transcript)
+			g := goldenSession(t, p.Dumpcap())
+			if p.Remaining() != 0 {
+				t.Error(p.Remaining())
+			}
+			// The transcript is named after the version recorded
+			if v := "dumpcap-" + g.version.String() + ".json"; v != filepath.Base(name) {
+				t.Error(v)
+			}
+			if len(g.device.LLTs) == 0 {
+				t.Error(g.device)
+			}
+			for i, ds := range g.stats {
+				if ds.Name != g.devices[i].Name {
+					t.Error(ds)
+				}
+			}
+			if len(g.messages) == 0 || g.messages[0].Type != FileMsg ||
+				g.messages[0].Text != goldenFileName {
+				t.Error(g.messages)
+			}
+			for _, msg := range g.messages {
+				if err := msg.Err(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// session calls dumpcap the way the tests of recording and replaying expect.
+type session struct {
+	version  string
+	devices  []Device
+	device   Device
+	stats    []DeviceStatistics
+	messages []PipeMessage
+}
+
+func runSession(t *testing.T, d *Dumpcap) session {
+	var s session
+	var err error
+	if s.version, err = d.Version(); err != nil {
+		t.Fatal(err)
+	}
+	if s.devices, err = d.Devices(false); err != nil {
+		t.Fatal(err)
+	}
+	s.device = Device{Name: "devX"}
+	if err = d.Capabilities(&s.device, false); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := d.NewStatistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ds, ok := <-stats.Stats
+		if !ok {
+			t.Fatal("there should be statistics")
+		}
+		s.stats = append(s.stats, ds)
+	}
+	go func() {
+		for range stats.Stats {
+		}
+	}()
+	if err = stats.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := d.NewCapture(Arguments{DeviceArgs: []DeviceArgument{{Name: "devX"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- c.Stop(time.Second) }()
+	for msg := range c.Messages {
+		s.messages = append(s.messages, msg)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	d := newMockcap(mockBlockArg)
+	// Only the capture waits to be stopped
+	d.newCommand = func(name string, arg ...string) Commander {
+		for _, a := range arg {
+			if a == fileArg {
+				return newMockCommand(name, append(arg, mockBlockArg)...)
+			}
+		}
+		return newMockCommand(name, arg...)
+	}
+	r := NewRecorder(&d)
+	recorded := runSession(t, &d)
+	if len(recorded.messages) != 3 || recorded.messages[1].PacketCount != 123 {
+		t.Fatal(recorded.messages)
+	}
+
+	name := filepath.Join(t.TempDir(), "transcript.json")
+	if err := r.Transcript().Save(name); err != nil {
+		t.Fatal(err)
+	}
+	transcript, err := LoadTranscript(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript.Sessions) != 5 || transcript.Sessions[4].Interrupted == 0 {
+		t.Fatal(transcript.Sessions)
+	}
+
+	p := NewReplayer(transcript)
+	replayed := runSession(t, p.Dumpcap())
+	if !reflect.DeepEqual(recorded, replayed) {
+		t.Errorf("%#v\n%#v", recorded, replayed)
+	}
+	if p.Remaining() != 0 {
+		t.Error(p.Remaining())
+	}
+	if _, err = p.Dumpcap().Version(); err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Error(err)
+	}
+}
+
+func TestReplayFailures(t *testing.T) {
+	d := newMockcap(mockFailExitArg)
+	r := NewRecorder(&d)
+	if _, err := d.Version(); err != errFailExit {
+		t.Fatal(err)
+	}
+	r.newCommand = newMockcap(mockFailStartArg).newCommand
+	if _, err := d.Version(); err != errFailStart {
+		t.Fatal(err)
+	}
+
+	p := NewReplayer(r.Transcript())
+	replay := p.Dumpcap()
+	if _, err := replay.Version(); err == nil || err.Error() != errFailExit.Error() {
+		t.Error(err)
+	}
+	if _, err := replay.Version(); err == nil || err.Error() != errFailStart.Error() {
+		t.Error(err)
+	}
+
+	// The arguments must match the transcript
+	p = NewReplayer(r.Transcript())
+	if _, err := p.Dumpcap().Devices(false); err == nil ||
+		!strings.HasPrefix(err.Error(), "replay: expected call to dumpcap -v") {
+		t.Error(err)
+	}
+	if p.Remaining() != 2 {
+		t.Error(p.Remaining())
+	}
+}
+
+func TestReplayExitError(t *testing.T) {
+	transcript := &Transcript{Sessions: []*Session{{Args: []string{machineReadableArg, listDevicesCmd},
+		Stdout:   []Chunk{{Data: []byte(interfacesOutput)}},
+		ExitCode: 1, ExitStderr: "no permission"}}}
+	d := NewReplayer(transcript).Dumpcap()
+	_, err := d.Devices(false)
+	if ee, ok := err.(*ExitError); !ok || ee.Code != 1 || ee.Stderr != "no permission" {
+		t.Error(err)
+	}
+}
+
+func TestRecordNetNamespace(t *testing.T) {
+	d := newMockcap()
+	d.NetNamespace = "blue"
+	r := NewRecorder(&d)
+	if _, err := d.Devices(false); err != nil {
+		t.Fatal(err)
+	}
+	// Only dumpcap's own arguments are recorded, so the transcript can be
+	// replayed regardless of the namespace
+	transcript := r.Transcript()
+	if args := strings.Join(transcript.Sessions[0].Args, " "); args != "-M -D" {
+		t.Error(args)
+	}
+	for _, ns := range []string{"", "blue"} {
+		p := NewReplayer(transcript)
+		replay := p.Dumpcap()
+		replay.NetNamespace = ns
+		if devices, err := replay.Devices(false); err != nil || len(devices) == 0 {
+			t.Error(ns, devices, err)
+		}
+	}
+}
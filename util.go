@@ -1,14 +1,52 @@
 package dumpcap
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"io"
 	"regexp"
 	"strconv"
-	"strings"
+	"sync"
+
+	"github.com/lukaslueg/dumpcap/syncpipe"
 )
 
+// afterFunc arranges to call f in it's own goroutine once ctx is done, like
+// context.AfterFunc of newer versions of go. Calling stop keeps f from being
+// called; it returns false if f was already started or stop was called before.
+func afterFunc(ctx context.Context, f func()) (stop func() bool) {
+	if ctx.Done() == nil {
+		// The context can never be done
+		var once sync.Once
+		return func() bool {
+			stopped := false
+			once.Do(func() { stopped = true })
+			return stopped
+		}
+	}
+	var once sync.Once
+	stopping := make(chan int)
+	go func() {
+		select {
+		case <-ctx.Done():
+			started := false
+			once.Do(func() { started = true })
+			if started {
+				f()
+			}
+		case <-stopping:
+		}
+	}()
+	return func() bool {
+		stopped := false
+		once.Do(func() {
+			stopped = true
+			close(stopping)
+		})
+		return stopped
+	}
+}
+
 // used to decode the output of "dumpcap -D -M"
 var deviceListRE = regexp.MustCompile(`(?m:^)` +
 	`(\d+)\. ` + // the device number
@@ -21,27 +59,62 @@ var deviceListRE = regexp.MustCompile(`(?m:^)` +
 	`(?m:\r?$)` + // newline
 	``)
 
-// The message headers that might arrive from dumpcap.
-// Taken from sync_pipe.h and hopefully not subject to change
+// The message headers that might arrive from dumpcap. See package syncpipe.
 const (
-	BadFilterMsg   byte = 66 // At least one of the given capture filters is invalid.
-	DropCountMsg        = 68 // Dumpcap reports the absolute number of packets dropped.
-	ErrMsg              = 69 // Dumcap reports a general error.
-	FileMsg             = 70 // Dumcap has started to write captured traffic to a new file.
-	PacketCountMsg      = 80 // Dumpap reports the number of packets written to the currently active file.
-	QuitMsg             = 81 // TODO Used on windows
-	SuccessMsg          = 83 // Dumpcap reports success execution.
+	BadFilterMsg      = syncpipe.BadFilterMsg      // At least one of the given capture filters is invalid.
+	DropCountMsg      = syncpipe.DropCountMsg      // Dumpcap reports the absolute number of packets dropped.
+	ErrMsg            = syncpipe.ErrMsg            // Dumcap reports a general error.
+	FileMsg           = syncpipe.FileMsg           // Dumcap has started to write captured traffic to a new file.
+	InterfaceListMsg  = syncpipe.InterfaceListMsg  // Dumpcap reports a list of interfaces or their capabilities.
+	PacketCountMsg    = syncpipe.PacketCountMsg    // Dumpap reports the number of packets written to the currently active file.
+	QuitMsg           = syncpipe.QuitMsg           // Sent to dumpcap to ask it to stop capturing; never received.
+	SuccessMsg        = syncpipe.SuccessMsg        // Dumpcap reports success execution.
+	ToolbarControlMsg = syncpipe.ToolbarControlMsg // Dumpcap forwards a control packet for an extcap interface toolbar.
 )
 
-var errUnknownMessageType = errors.New("unknown message type")
-
 // PipeMessage represents messages send by dumpcap to inform about various
 // events.
 type PipeMessage struct {
-	Type        byte   // One of BadFilterMsg, ErrMsg, etc.
-	DropCount   uint64 // The absolute number of packets dropped. Only filled for DropCountMsg.
-	PacketCount uint64 // The number of packets written to the currently active file. Only filled for PacketCountMsg.
-	Text        string // Contains the message's text for BadFilterMsg, ErrMsg and SuccessMsg; contains the filename for FileMsg.
+	Type           byte            // One of BadFilterMsg, ErrMsg, etc.
+	DropCount      uint64          // The absolute number of packets dropped. Only filled for DropCountMsg.
+	PacketCount    uint64          // The number of packets written to the currently active file. Only filled for PacketCountMsg.
+	Text           string          // Contains the message's text for BadFilterMsg, ErrMsg and SuccessMsg; contains the filename for FileMsg.
+	FinalFileName  string          // The name the file reported by FileMsg will have once dumpcap is done with it, e.g. "foo.pcapng.gz" if it gets compressed. Only filled for FileMsg.
+	Primary        string          // The primary part of an ErrMsg's text. Only filled for ErrMsg.
+	Secondary      string          // The secondary part of an ErrMsg's text, may be empty. Only filled for ErrMsg.
+	InterfaceIndex int             // The index of the interface whose capture filter is bad, -1 if unknown. Only filled for BadFilterMsg.
+	Device         *DeviceArgument // The element of Arguments.DeviceArgs InterfaceIndex refers to, if known. Only filled for BadFilterMsg.
+	Raw            []byte          // The undecoded message; the only content of messages of types unknown to this package.
+	filter         string          // the offending capture filter, if known
+}
+
+// Err returns a *CaptureError for ErrMsg and a *BadFilterError for
+// BadFilterMsg; returns nil for all other messages.
+func (m PipeMessage) Err() error {
+	switch m.Type {
+	case ErrMsg:
+		return &CaptureError{Primary: m.Primary, Secondary: m.Secondary}
+	case BadFilterMsg:
+		e := &BadFilterError{Filter: m.filter, Message: m.Text}
+		if m.Device != nil {
+			e.Interface = m.Device.Name
+		}
+		return e
+	}
+	return nil
+}
+
+// resolveBadFilter associates a BadFilterMsg with the DeviceArgument and
+// capture filter it refers to.
+func (a Arguments) resolveBadFilter(msg *PipeMessage) {
+	msg.filter = a.CaptureFilter
+	if msg.InterfaceIndex < 0 || msg.InterfaceIndex >= len(a.DeviceArgs) {
+		return
+	}
+	msg.Device = &a.DeviceArgs[msg.InterfaceIndex]
+	if msg.Device.CaptureFilter != "" {
+		msg.filter = msg.Device.CaptureFilter
+	}
 }
 
 // DeviceType represents device types like USB or WiFi as reported by dumpcap.
@@ -88,39 +161,87 @@ func (dt DeviceType) String() string {
 
 // Arguments passed to dumpcap
 const (
-	autoStopConditionArg  string = "-a"
-	bufferedBytesArg             = "-C"
-	bufferedPacketsArg           = "-N"
-	captureFilterArg             = "-f"
-	disablePromiscuousArg        = "-p"
-	durationArg                  = "duration"
-	enableGroupAccessArg         = "-g"
-	enableMonitorModeArg         = "-I"
-	filesArg                     = "files"
-	filesizeArg                  = "filesize"
-	interfaceArg                 = "-i"
-	kernelBufferSizeArg          = "-B"
-	linkLayerTypeArg             = "-y"
-	machineReadableArg           = "-M"
-	fileArg                      = "-w"
-	packetCountArg               = "-c"
-	pipeOutputArg                = "-Z"
-	ringbufferArg                = "-b"
-	snaplenArg                   = "-s"
-	stopPacketCountArg           = "-c"
-	usePCAPArg                   = "-P"
-	usePCAPNGArg                 = "-n"
-	useThreadsArg                = "-t"
-	wifiChannelArg               = "-k"
+	autoStopConditionArg       string = "-a"
+	bufferedBytesArg                  = "-C"
+	bufferedPacketsArg                = "-N"
+	captureCommentArg                 = "--capture-comment"
+	captureFilterArg                  = "-f"
+	compressTypeArg                   = "--compress-type"
+	countArg                          = "count"
+	disablePromiscuousArg             = "-p"
+	durationArg                       = "duration"
+	enableGroupAccessArg              = "-g"
+	enableMonitorModeArg              = "-I"
+	filesArg                          = "files"
+	filesizeArg                       = "filesize"
+	ifDescriptionArg                  = "--ifdescr"
+	ifNameArg                         = "--ifname"
+	interfaceArg                      = "-i"
+	intervalArg                       = "interval"
+	kernelBufferSizeArg               = "-B"
+	linkLayerTypeArg                  = "-y"
+	machineReadableArg                = "-M"
+	nameTimeNumArg                    = "nametimenum"
+	fileArg                           = "-w"
+	packetCountArg                    = "-c"
+	packetsArg                        = "packets"
+	pipeOutputArg                     = "-Z"
+	printNameArg                      = "printname"
+	remoteAuthArg                     = "-A"
+	remoteCaptureOwnTrafficArg        = "-r"
+	remoteUDPArg                      = "-u"
+	ringbufferArg                     = "-b"
+	samplingArg                       = "-m"
+	snaplenArg                        = "-s"
+	stopPacketCountArg                = "-c"
+	tempDirArg                        = "--temp-dir"
+	timerArg                          = "timer"
+	timestampPrecisionArg             = "--time-stamp-precision"
+	timestampTypeArg                  = "--time-stamp-type"
+	usePCAPArg                        = "-P"
+	usePCAPNGArg                      = "-n"
+	useThreadsArg                     = "-t"
+	wifiChannelArg                    = "-k"
+)
+
+// Running dumpcap inside a network namespace using nsenter
+const (
+	netNamespaceArg   = "--net="
+	netNamespaceDir   = "/run/netns/"
+	nsenterExecutable = "nsenter"
+	procNamespaceFmt  = "/proc/%s/ns/%s"
+	userNamespaceArg  = "--user="
+)
+
+// Interfaces whose name starts with one of these prefixes are captured from
+// remotely; "TCP@<host>:<port>" is the legacy syntax of older versions
+const (
+	rpcapPrefix     = "rpcap://"
+	tcpRemotePrefix = "TCP@"
+)
+
+// The values of timestampPrecisionArg
+const (
+	microPrecision = "micro"
+	nanoPrecision  = "nano"
 )
 
+// The values of compressTypeArg
+const gzipCompression = "gzip"
+
+// The suffix dumpcap adds to the name of files it compressed using gzip
+const gzipSuffix = ".gz"
+
 // Commands passed to dumpcap
 const (
-	captureCmd     string = ""
-	listDevicesCmd        = "-D"
-	listLayersCmd         = "-L"
-	statsCmd              = "-S"
-	versionCmd            = "-v"
+	captureCmd            string = ""
+	compileFilterCmd             = "-d"
+	helpCmd                      = "-h"
+	listDevicesCmd               = "-D"
+	listLayersCmd                = "-L"
+	listTimestampTypesCmd        = "--list-time-stamp-types"
+	statsCmd                     = "-S"
+	versionCmd                   = "-v"
 )
 
 // File formats dumpcap can write
@@ -130,101 +251,62 @@ const (
 	UsePCAPNG            // Use PCAP-ng by default
 )
 
-// The string returned by VersionString() in case Version() reports an error
-const UnknownVersion string = "unknown"
-
-// parsePipeMsg reads one message from the given reader and returns it's type
-// and it's associated message text.
-func parsePipeMsg(input io.Reader) (msgType uint8, msg []byte, err error) {
-	// The header is four bytes, one for type of message, three for size of
-	// following message text
-	var buffer []byte
-	buffer = make([]byte, 4)
-	_, err = io.ReadFull(input, buffer)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	msgType = buffer[0]
-	switch msgType {
-	case BadFilterMsg, DropCountMsg, ErrMsg, FileMsg, PacketCountMsg, QuitMsg, SuccessMsg:
-	default:
-		return 0, nil, errUnknownMessageType
-	}
+// Compression of ringbuffer files
+const (
+	NoCompression      = iota
+	UseGzipCompression // Compress ringbuffer files using gzip once they are written
+)
 
-	msgSize := (int(buffer[1]) << 16) | (int(buffer[2]) << 8) | (int(buffer[3]) << 0)
-	if msgSize == 0 {
-		return msgType, nil, nil
-	}
-	buffer = make([]byte, msgSize)
-	_, err = io.ReadFull(input, buffer)
-	if err != nil {
-		return 0, nil, err
-	}
-	return msgType, buffer, nil
-}
+// The FileName which causes dumpcap to write captured packets to it's standard
+// output instead of a file. See Capture.Packets().
+const StdoutFileName string = "-"
 
-// parsePipeErrMsg reads the message text associated with an ErrMsg.
-func parsePipeErrMsg(input io.Reader) (string, error) {
-	// There will be a primary and a secondary message which we just
-	// concatenate
-	_, err1, err := parsePipeMsg(input)
-	if err != nil {
-		return "", err
-	}
-	_, err2, err := parsePipeMsg(input)
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSuffix(string(err1), "\x00") + strings.TrimSuffix(string(err2), "\x00"), nil
-}
+// The string returned by VersionString() in case Version() reports an error
+const UnknownVersion string = "unknown"
 
 // readPipeMsg completely decodes a message sent by dumpcap.
 func readPipeMsg(input io.Reader) (msg *PipeMessage, err error) {
-	msg = &PipeMessage{}
-	msgType, msgBuffer, err := parsePipeMsg(input)
+	m, err := syncpipe.NewReader(input).ReadMessage()
 	if err != nil {
 		return nil, err
 	}
-	msg.Type = msgType
-	msg.Text = strings.TrimSuffix(string(msgBuffer), "\x00")
-
-	if msgType == DropCountMsg {
-		i, err := strconv.ParseUint(msg.Text, 10, 0)
-		if err != nil {
-			return nil, err
-		}
-		msg.DropCount = i
-	} else if msgType == ErrMsg {
-		errmsg, err := parsePipeErrMsg(bytes.NewReader(msgBuffer))
-		if err != nil {
-			return nil, err
-		}
-		msg.Text = errmsg
-	} else if msgType == PacketCountMsg {
-		i, err := strconv.ParseUint(msg.Text, 10, 0)
-		if err != nil {
-			return nil, err
-		}
-		msg.PacketCount = i
+	msg = &PipeMessage{Type: m.Type, Text: m.Text, Raw: m.Raw}
+	switch m.Type {
+	case BadFilterMsg:
+		msg.InterfaceIndex = m.InterfaceIndex
+	case DropCountMsg:
+		msg.DropCount = m.Count
+		msg.Text = strconv.FormatUint(m.Count, 10)
+	case PacketCountMsg:
+		msg.PacketCount = m.Count
+		msg.Text = strconv.FormatUint(m.Count, 10)
+	case ErrMsg:
+		msg.Primary, msg.Secondary = m.Primary, m.Secondary
+		// Text keeps both parts for callers not interested in the details
+		msg.Text = m.Primary + m.Secondary
 	}
 	return msg, nil
 }
 
 // waitForSuccessMsg calls readPipeMsg and returns nil if and only if a
-// success-message is decoded.
-func waitForSuccessMsg(input io.Reader) error {
-	msg, err := readPipeMsg(input)
-	if err != nil {
-		return err
-	}
-	switch msg.Type {
-	case SuccessMsg:
-		return nil
-	case ErrMsg, BadFilterMsg:
-		return errors.New(msg.Text)
-	default:
-		return errors.New("unexpected message from dumpcap: " + string(msg.Type))
+// success-message is decoded. A bad filter is reported in terms of the given
+// Arguments dumpcap was started with. Messages of unknown type are skipped.
+func waitForSuccessMsg(input io.Reader, args Arguments) error {
+	for {
+		msg, err := readPipeMsg(input)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case SuccessMsg:
+			return nil
+		case BadFilterMsg:
+			args.resolveBadFilter(msg)
+			return msg.Err()
+		case ErrMsg:
+			return msg.Err()
+		case DropCountMsg, FileMsg, InterfaceListMsg, PacketCountMsg, QuitMsg, ToolbarControlMsg:
+			return errors.New("unexpected message from dumpcap: " + string(msg.Type))
+		}
 	}
-	return nil
 }
@@ -0,0 +1,200 @@
+package dumpcap
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// used to decode the first line of "dumpcap -v"
+var versionRE = regexp.MustCompile(`^Dumpcap(?: \([^)]*\))? ` +
+	`(\d+)\.(\d+)\.(\d+)\S*` + // major, minor and patch
+	`(?: \((.*)\))?` + // the git revision
+	`\.?\s*$`)
+
+// used to decode the version of a library from "zlib 1.2.11" or
+// "libpcap version 1.10.1 (with TPACKET_V3)"
+var libraryVersionRE = regexp.MustCompile(`^(?: version)? ([0-9][\w.\-+~]*)`)
+
+// used to find the compiler in outputs of older versions of dumpcap
+var builtUsingRE = regexp.MustCompile(`(?m)^Built using (.*?)\.?\s*$`)
+
+var errIllegalVersion = errors.New("illegal version output from dumpcap")
+
+// VersionInfo represents the version of dumpcap and the libraries and features
+// it was compiled and is running with, as reported by "dumpcap -v".
+type VersionInfo struct {
+	Major        uint
+	Minor        uint
+	Patch        uint
+	GitRev       string   // e.g. "Git v3.6.2 packaged as 3.6.2-2"
+	Compiler     string   // e.g. "GCC 11.2.0", if known
+	OS           string   // The operating system dumpcap is running on, if known
+	CompiledWith []string // e.g. "libpcap", "zlib 1.2.11" or "POSIX capabilities (Linux)"
+	RunningWith  []string // e.g. "libpcap version 1.10.1 (with TPACKET_V3)"
+}
+
+// String returns the version as "Major.Minor.Patch".
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Compare returns -1, 0 or 1 if the version is lower than, equal to or
+// greater than the given version.
+func (v VersionInfo) Compare(major, minor, patch uint) int {
+	a := [3]uint{v.Major, v.Minor, v.Patch}
+	b := [3]uint{major, minor, patch}
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast returns true if the version is equal to or greater than the given
+// version.
+func (v VersionInfo) AtLeast(major, minor, patch uint) bool {
+	return v.Compare(major, minor, patch) >= 0
+}
+
+// findLibrary returns the remainder of the first entry starting with name.
+func findLibrary(entries []string, name string) (string, bool) {
+	for _, e := range entries {
+		if e == name {
+			return "", true
+		}
+		if strings.HasPrefix(e, name+" ") {
+			return e[len(name):], true
+		}
+	}
+	return "", false
+}
+
+// Compiled returns true if dumpcap was compiled with the given library or
+// feature, e.g. "libpcap", "zlib" or "POSIX capabilities".
+func (v VersionInfo) Compiled(name string) bool {
+	_, ok := findLibrary(v.CompiledWith, name)
+	return ok
+}
+
+// LibraryVersion returns the version of the given library, e.g. "libpcap",
+// dumpcap is running with. The version dumpcap was compiled with is returned
+// if the running version is unknown. Returns "" if the version is not known
+// at all.
+func (v VersionInfo) LibraryVersion(name string) string {
+	for _, entries := range [][]string{v.RunningWith, v.CompiledWith} {
+		if rest, ok := findLibrary(entries, name); ok {
+			if m := libraryVersionRE.FindStringSubmatch(rest); m != nil {
+				return m[1]
+			}
+		}
+	}
+	return ""
+}
+
+// splitVersionSection splits a paragraph like "Compiled (64-bit) using GCC,
+// with libpcap, with zlib 1.2.11." at commas not enclosed in parentheses.
+func splitVersionSection(s string) []string {
+	s = strings.TrimSuffix(strings.Join(strings.Fields(s), " "), ".")
+	var entries []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				entries = append(entries, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(entries, strings.TrimSpace(s[start:]))
+}
+
+// parseVersionSection distributes the entries of a "Compiled..." or
+// "Running..." paragraph.
+func parseVersionSection(s string, head func(string), with *[]string) {
+	for i, e := range splitVersionSection(s) {
+		if i == 0 {
+			// e.g. "Compiled (64-bit) using GCC 11.2.0" or "Running on Linux"
+			// or "Compiled (64-bit) with libpcap"
+			fields := strings.SplitN(e, " ", 2)
+			if len(fields) < 2 {
+				continue
+			}
+			e = strings.TrimSpace(fields[1])
+			if strings.HasPrefix(e, "(") {
+				if j := strings.Index(e, ")"); j >= 0 {
+					e = strings.TrimSpace(e[j+1:])
+				}
+			}
+			if !strings.HasPrefix(e, "with ") {
+				head(e)
+				continue
+			}
+		}
+		if strings.HasPrefix(e, "with ") {
+			*with = append(*with, strings.TrimPrefix(e, "with "))
+		}
+	}
+}
+
+// ParseVersion decodes the complete output of "dumpcap -v".
+func ParseVersion(output string) (*VersionInfo, error) {
+	output = strings.Replace(output, "\r\n", "\n", -1)
+	lines := strings.SplitN(output, "\n", 2)
+	m := versionRE.FindStringSubmatch(lines[0])
+	if m == nil {
+		return nil, errIllegalVersion
+	}
+
+	v := VersionInfo{GitRev: m[4]}
+	for i, p := range []*uint{&v.Major, &v.Minor, &v.Patch} {
+		n, err := strconv.ParseUint(m[i+1], 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		*p = uint(n)
+	}
+	if len(lines) < 2 {
+		return &v, nil
+	}
+
+	rest := lines[1]
+	if m = builtUsingRE.FindStringSubmatch(rest); m != nil {
+		v.Compiler = m[1]
+		rest = builtUsingRE.ReplaceAllString(rest, "")
+	}
+	for _, paragraph := range strings.Split(rest, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		switch {
+		case strings.HasPrefix(paragraph, "Compiled "):
+			parseVersionSection(paragraph, func(s string) {
+				v.Compiler = strings.TrimPrefix(s, "using ")
+			}, &v.CompiledWith)
+		case strings.HasPrefix(paragraph, "Running "):
+			parseVersionSection(paragraph, func(s string) {
+				v.OS = strings.TrimPrefix(s, "on ")
+			}, &v.RunningWith)
+		}
+	}
+	return &v, nil
+}
+
+// VersionInfo calls "dumpcap -v" and decodes it's complete output.
+func (d *Dumpcap) VersionInfo() (*VersionInfo, error) {
+	buf, err := d.command(versionCmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	return ParseVersion(string(buf))
+}
@@ -0,0 +1,140 @@
+package dumpcap
+
+import (
+	"testing"
+)
+
+const (
+	versionOutput112 = "Dumpcap 1.12.1 (Git Rev Unknown from unknown)\n" +
+		"\n" +
+		"Copyright 1998-2014 Gerald Combs <gerald@wireshark.org> and contributors.\n" +
+		"This is free software; see the source for copying conditions. There is NO\n" +
+		"warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.\n" +
+		"\n" +
+		"Compiled (64-bit) with libpcap, with POSIX capabilities (Linux), with libnl 3,\n" +
+		"with GLib 2.42.0, with zlib 1.2.8.\n" +
+		"\n" +
+		"Running on Linux 3.16.0-4-amd64, with locale en_US.UTF-8, with libpcap version\n" +
+		"1.6.2, with libz 1.2.8, with POSIX capabilities (Linux).\n" +
+		"Built using gcc 4.9.1.\n"
+	versionOutput36 = "Dumpcap (Wireshark) 3.6.2 (Git v3.6.2 packaged as 3.6.2-2)\n" +
+		"\n" +
+		"Copyright 1998-2022 Gerald Combs <gerald@wireshark.org> and contributors.\n" +
+		"License GPLv2+: GNU GPL version 2 or later <https://www.gnu.org/licenses/gpl-2.0.html>\n" +
+		"This is free software; see the source for copying conditions. There is NO\n" +
+		"warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.\n" +
+		"\n" +
+		"Compiled (64-bit) using GCC 11.2.0, with libpcap, with POSIX capabilities\n" +
+		"(Linux), with libnl 3, with GLib 2.71.2, with zlib 1.2.11, without Nghttp2.\n" +
+		"\n" +
+		"Running on Linux 5.15.0-56-generic, with Intel(R) Core(TM) i7-8550U CPU @\n" +
+		"1.80GHz (with SSE4.2), with 15896 MB of physical memory, with GLib 2.72.1,\n" +
+		"with zlib 1.2.11, with libpcap version 1.10.1 (with TPACKET_V3), with POSIX\n" +
+		"capabilities (Linux), with libnl 3, with LC_TYPE=en_US.UTF-8, binary plugins\n" +
+		"supported (0 loaded).\n"
+	versionOutput42 = "Dumpcap (Wireshark) 4.2.0 (v4.2.0-0-g8fd8ea7f8bb5).\n" +
+		"\n" +
+		"Copyright 1998-2023 Gerald Combs <gerald@wireshark.org> and contributors.\n" +
+		"Licensed under the terms of the GNU General Public License (version 2 or later).\n" +
+		"This is free software; see the file named COPYING in the distribution. There is\n" +
+		"NO WARRANTY; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.\n" +
+		"\n" +
+		"Compiled (64-bit) using GCC 13.2.1 20230801, with GLib 2.78.0, with libpcap,\n" +
+		"with POSIX capabilities (Linux), with libnl 3, with zlib 1.3, with Zstandard\n" +
+		"1.5.5, with LZ4 1.9.4, with Snappy 1.1.10, with LibXML2 2.11.5.\n" +
+		"\n" +
+		"Running on Linux 6.5.5-arch1-1, with 12th Gen Intel(R) Core(TM) i7-1260P (with\n" +
+		"SSE4.2), with 31795 MB of physical memory, with GLib 2.78.0, with libpcap\n" +
+		"version 1.10.4 (with TPACKET_V3), with zlib 1.3, with libnl 3, with Zstandard\n" +
+		"1.5.5, with LZ4 1.9.4, with Snappy 1.1.10, with LibXML2 2.11.5, binary plugins\n" +
+		"supported.\n"
+)
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion(versionOutput36)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Major != 3 || v.Minor != 6 || v.Patch != 2 || v.String() != "3.6.2" ||
+		v.GitRev != "Git v3.6.2 packaged as 3.6.2-2" || v.Compiler != "GCC 11.2.0" ||
+		v.OS != "Linux 5.15.0-56-generic" {
+		t.Errorf("%#v", v)
+	}
+	if len(v.CompiledWith) != 5 || v.CompiledWith[1] != "POSIX capabilities (Linux)" {
+		t.Errorf("%#v", v.CompiledWith)
+	}
+	if !v.Compiled("libpcap") || !v.Compiled("POSIX capabilities") || v.Compiled("Nghttp2") {
+		t.Error(v.CompiledWith)
+	}
+	if lv := v.LibraryVersion("libpcap"); lv != "1.10.1" {
+		t.Error(lv)
+	}
+	if lv := v.LibraryVersion("zlib"); lv != "1.2.11" {
+		t.Error(lv)
+	}
+	if lv := v.LibraryVersion("libnl"); lv != "3" {
+		t.Error(lv)
+	}
+	if lv := v.LibraryVersion("foobar"); lv != "" {
+		t.Error(lv)
+	}
+
+	v, err = ParseVersion(versionOutput112)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "1.12.1" || v.GitRev != "Git Rev Unknown from unknown" ||
+		v.Compiler != "gcc 4.9.1" || v.OS != "Linux 3.16.0-4-amd64" {
+		t.Errorf("%#v", v)
+	}
+	if len(v.CompiledWith) != 5 || v.CompiledWith[0] != "libpcap" || !v.Compiled("zlib") {
+		t.Errorf("%#v", v.CompiledWith)
+	}
+	if lv := v.LibraryVersion("libpcap"); lv != "1.6.2" {
+		t.Error(lv)
+	}
+
+	v, err = ParseVersion(versionOutput42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "4.2.0" || v.GitRev != "v4.2.0-0-g8fd8ea7f8bb5" ||
+		v.Compiler != "GCC 13.2.1 20230801" || v.OS != "Linux 6.5.5-arch1-1" {
+		t.Errorf("%#v", v)
+	}
+	if lv := v.LibraryVersion("libpcap"); lv != "1.10.4" {
+		t.Error(lv)
+	}
+	// The version alone, as printed by "dumpcap -v" of 4.x
+	if v, err = ParseVersion("Dumpcap (Wireshark) 4.2.0 (v4.2.0-0-g8fd8ea7f8bb5).\n"); err != nil ||
+		v.GitRev != "v4.2.0-0-g8fd8ea7f8bb5" {
+		t.Error(v, err)
+	}
+
+	if _, err = ParseVersion(gibberish); err != errIllegalVersion {
+		t.Error(err)
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	v := VersionInfo{Major: 3, Minor: 6, Patch: 2}
+	if !v.AtLeast(3, 6, 0) || !v.AtLeast(3, 6, 2) || v.AtLeast(3, 6, 3) ||
+		v.AtLeast(4, 0, 0) || !v.AtLeast(2, 99, 99) {
+		t.Error(v)
+	}
+	if v.Compare(3, 6, 2) != 0 || v.Compare(3, 5, 9) != 1 || v.Compare(3, 10, 0) != -1 {
+		t.Error(v)
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	d := newMockcap()
+	// The mocked version-command does not look like dumpcap
+	if _, err := d.VersionInfo(); err != errIllegalVersion {
+		t.Error(err)
+	}
+	d = newMockcap(mockFailExitArg)
+	if _, err := d.VersionInfo(); err != errFailExit {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,205 @@
+package dumpcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var errInvalidInterval = errors.New("the interval to poll devices at must be positive")
+
+// DeviceEvent is one of DeviceAdded, DeviceRemoved, DeviceChanged or
+// DeviceError.
+type DeviceEvent interface {
+	fmt.Stringer
+	deviceEvent()
+}
+
+// DeviceAdded reports a device which was not listed before.
+type DeviceAdded struct {
+	Device Device
+}
+
+// DeviceRemoved reports a device which is no longer listed.
+type DeviceRemoved struct {
+	Device Device
+}
+
+// DeviceChanged reports a device whose properties, e.g. it's addresses, have
+// changed.
+type DeviceChanged struct {
+	Old Device // The device as listed before
+	New Device // The device as listed now
+}
+
+// DeviceError reports that listing the devices failed. The list is polled
+// again after the interval; changes are reported relative to the last list
+// known.
+type DeviceError struct {
+	Err error
+}
+
+func (DeviceAdded) deviceEvent()   {}
+func (DeviceRemoved) deviceEvent() {}
+func (DeviceChanged) deviceEvent() {}
+func (DeviceError) deviceEvent()   {}
+
+func (e DeviceAdded) String() string {
+	return "added " + e.Device.String()
+}
+
+func (e DeviceRemoved) String() string {
+	return "removed " + e.Device.String()
+}
+
+func (e DeviceChanged) String() string {
+	return "changed " + e.New.String()
+}
+
+func (e DeviceError) String() string {
+	return "error " + e.Err.Error()
+}
+
+// DeviceWatcher reports changes to the list of devices.
+type DeviceWatcher struct {
+	Events chan DeviceEvent
+	done   chan int
+	err    error
+}
+
+// WatchDevices calls dumpcap to list all devices and then polls the list
+// every interval, comparing each list to the one before. Devices are
+// identified by their Name; the devices listed first are reported as
+// DeviceAdded. If getCapabilities is true, the capabilities of all devices are
+// queried as well, like Devices does; a device whose capabilities can't be
+// queried, e.g. because it vanished in between, is reported with the
+// capabilities known from before.
+// The watcher runs until the given context is done, after which
+// DeviceWatcher.Events is closed; dumpcap failing to list the devices is
+// reported as DeviceError. An error listing the devices the first time is
+// returned immediately; so is an error if interval is not positive, without
+// calling dumpcap.
+func (d *Dumpcap) WatchDevices(ctx context.Context, interval time.Duration, getCapabilities bool) (*DeviceWatcher, error) {
+	if interval <= 0 {
+		return nil, errInvalidInterval
+	}
+	devices, err := d.watchedDevices(ctx, getCapabilities, nil)
+	if err != nil {
+		return nil, err
+	}
+	w := &DeviceWatcher{Events: make(chan DeviceEvent), done: make(chan int)}
+	go w.watch(ctx, d, interval, getCapabilities, devices)
+	return w, nil
+}
+
+// watchedDevices lists all devices and, if getCapabilities is true, their
+// capabilities. The capabilities of devices which can't be queried are taken
+// from the previous list.
+func (d *Dumpcap) watchedDevices(ctx context.Context, getCapabilities bool, previous []Device) ([]Device, error) {
+	devices, err := d.DevicesContext(ctx, false)
+	if err != nil || !getCapabilities {
+		return devices, err
+	}
+	for i := range devices {
+		if err = d.CapabilitiesContext(ctx, &devices[i], false); err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		for _, prev := range previous {
+			if prev.Name == devices[i].Name {
+				devices[i].CanRFMon = prev.CanRFMon
+				devices[i].LLTs = prev.LLTs
+			}
+		}
+	}
+	return devices, nil
+}
+
+// watch delivers the events and polls dumpcap until the context is done.
+func (w *DeviceWatcher) watch(ctx context.Context, d *Dumpcap, interval time.Duration, getCapabilities bool, devices []Device) {
+	defer close(w.done)
+	defer close(w.Events)
+	events := diffDevices(nil, devices)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, e := range events {
+			select {
+			case w.Events <- e:
+			case <-ctx.Done():
+				w.err = ctx.Err()
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			w.err = ctx.Err()
+			return
+		}
+		current, err := d.watchedDevices(ctx, getCapabilities, devices)
+		if err != nil {
+			// If the context is done, the next iteration stops the watcher
+			events = nil
+			if ctx.Err() == nil {
+				events = []DeviceEvent{DeviceError{Err: err}}
+			}
+			continue
+		}
+		events = diffDevices(devices, current)
+		devices = current
+	}
+}
+
+// sameDevice returns true if both devices have the same properties. The
+// Number is not compared, as it changes whenever devices listed before are
+// added or removed.
+func sameDevice(a, b Device) bool {
+	a.Number = b.Number
+	return reflect.DeepEqual(a, b)
+}
+
+// diffDevices returns the events turning the old list of devices into the new
+// one: Removed devices in their old order, then changed and added devices in
+// their new order.
+func diffDevices(old, current []Device) []DeviceEvent {
+	var events []DeviceEvent
+	byName := make(map[string]Device, len(current))
+	for _, dev := range current {
+		byName[dev.Name] = dev
+	}
+	for _, dev := range old {
+		if _, ok := byName[dev.Name]; !ok {
+			events = append(events, DeviceRemoved{Device: dev})
+		}
+	}
+	byName = make(map[string]Device, len(old))
+	for _, dev := range old {
+		byName[dev.Name] = dev
+	}
+	for _, dev := range current {
+		prev, ok := byName[dev.Name]
+		if !ok {
+			events = append(events, DeviceAdded{Device: dev})
+		} else if !sameDevice(prev, dev) {
+			events = append(events, DeviceChanged{Old: prev, New: dev})
+		}
+	}
+	return events
+}
+
+// Wait until the watcher has stopped. Returns the context's error, as the
+// watcher stops only once the context given to WatchDevices is done.
+func (w *DeviceWatcher) Wait() error {
+	<-w.done
+	return w.err
+}
+
+// WatchDevices is a convenience-function to execute WatchDevices() on a new Dumpcap-struct
+func WatchDevices(ctx context.Context, interval time.Duration, getCapabilities bool) (*DeviceWatcher, error) {
+	return NewDumpcap().WatchDevices(ctx, interval, getCapabilities)
+}
@@ -0,0 +1,161 @@
+package dumpcap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newWatchcap returns a Dumpcap which lists the given outputs of "dumpcap -D",
+// one per call and repeating the last one; dumpcap fails instead of listing
+// mockFailExitArg. Capabilities can be queried only once per device.
+func newWatchcap(outputs ...string) (*Dumpcap, func() int) {
+	var mu sync.Mutex
+	var listed int
+	queried := make(map[string]bool)
+	d := NewDumpcapWithRunner(func(name string, arg ...string) Commander {
+		mu.Lock()
+		defer mu.Unlock()
+		s := &Session{Args: arg}
+		if arg[len(arg)-1] == listDevicesCmd {
+			if outputs[listed] == mockFailExitArg {
+				s.ExitCode = 1
+			} else {
+				s.Stdout = []Chunk{{Data: []byte(outputs[listed])}}
+			}
+			if listed < len(outputs)-1 {
+				listed++
+			}
+		} else {
+			device := arg[len(arg)-1]
+			if queried[device] {
+				s.Stderr = []Chunk{{Data: generateErrorMsg(errText1, errText2)}}
+				s.ExitCode = 1
+			} else {
+				s.Stderr = []Chunk{{Data: generateMsg(SuccessMsg, successText)}}
+				s.Stdout = []Chunk{{Data: []byte(layersOutput)}}
+			}
+			queried[device] = true
+		}
+		return NewReplayer(&Transcript{Sessions: []*Session{s}}).Command(name, arg...)
+	})
+	return d, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return listed
+	}
+}
+
+func TestWatchDevices(t *testing.T) {
+	d, _ := newWatchcap(interfacesOutput,
+		"1. em1\t\t\t0\t10.0.0.1\tnetwork\n"+
+			"2. lo\t\tLoopback\t0\t127.0.0.1,::1\tloopback\n"+
+			"3. veth0\t\t\t0\t\tnetwork\n",
+		"1. lo\t\tLoopback\t0\t127.0.0.1,::1\tloopback\n"+
+			"2. veth0\t\t\t0\t\tnetwork\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := d.WatchDevices(ctx, time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	for e := range w.Events {
+		events = append(events, e.String())
+		if c, ok := e.(DeviceChanged); ok && (len(c.Old.Addresses) != 0 || c.New.Addresses[0] != "10.0.0.1") {
+			t.Error(c)
+		}
+		if len(events) == 5 {
+			cancel()
+		}
+	}
+	expected := []string{"added em1", "added lo", "changed em1", "added veth0", "removed em1"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Error(events)
+	}
+	if err = w.Wait(); err != context.Canceled {
+		t.Error(err)
+	}
+}
+
+func TestWatchDevicesCapabilities(t *testing.T) {
+	d, listed := newWatchcap(interfacesOutput, interfacesOutput)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := d.WatchDevices(ctx, time.Millisecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []DeviceEvent
+	go func() {
+		// The capabilities known from before are kept once they can't be
+		// queried anymore
+		for listed() < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	for e := range w.Events {
+		events = append(events, e)
+	}
+	if len(events) != 2 {
+		t.Fatal(events)
+	}
+	if added, ok := events[0].(DeviceAdded); !ok || len(added.Device.LLTs) != 2 {
+		t.Error(events[0])
+	}
+	if err = w.Wait(); err != context.Canceled {
+		t.Error(err)
+	}
+}
+
+func TestWatchDevicesFails(t *testing.T) {
+	d := newMockcap(mockFailStartArg)
+	if _, err := d.WatchDevices(context.Background(), time.Second, false); err != errFailStart {
+		t.Error(err)
+	}
+	// The interval is checked before dumpcap is called
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := d.WatchDevices(context.Background(), interval, false); err != errInvalidInterval {
+			t.Error(interval, err)
+		}
+	}
+
+	// A failed poll is reported, the devices are compared to the last list
+	// known afterwards
+	d2, _ := newWatchcap(interfacesOutput, mockFailExitArg,
+		"1. lo\t\tLoopback\t0\t127.0.0.1,::1\tloopback\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := d2.WatchDevices(ctx, time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for e := range w.Events {
+		events = append(events, e.String())
+		if failed, ok := e.(DeviceError); ok {
+			var ee *ExitError
+			if !errors.As(failed.Err, &ee) || ee.Code != 1 {
+				t.Error(failed.Err)
+			}
+			events[len(events)-1] = "error"
+		}
+		if len(events) == 4 {
+			cancel()
+		}
+	}
+	expected := []string{"added em1", "added lo", "error", "removed em1"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Error(events)
+	}
+	if err = w.Wait(); err != context.Canceled {
+		t.Error(err)
+	}
+}